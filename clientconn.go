@@ -0,0 +1,50 @@
+package capngopher
+
+import (
+	"context"
+
+	"zombiezen.com/go/capnproto2"
+	"zombiezen.com/go/capnproto2/rpc"
+)
+
+// A ClientConn is an RPC connection opened by a client, together with
+// the bootstrap capability of the vat it is connected to.
+type ClientConn struct {
+	*rpc.Conn
+
+	// Client is the remote vat's bootstrap capability. Wrap it in its
+	// generated type to make calls, such as service.Pinger{Client: c.Client}.
+	Client capnp.Client
+
+	transport rpc.Transport
+}
+
+// NewClientConn starts an RPC connection on t and asks the remote vat
+// for its bootstrap capability.
+func NewClientConn(t rpc.Transport, options ...rpc.ConnOption) *ClientConn {
+	conn := rpc.NewConn(t, options...)
+	return &ClientConn{
+		Conn:      conn,
+		Client:    conn.Bootstrap(context.Background()),
+		transport: t,
+	}
+}
+
+// Wait waits until the connection is closed and returns why, like
+// Conn.Wait on a server.
+func (c *ClientConn) Wait() error {
+	return waitErr(c.Conn, c.transport)
+}
+
+// GoingAway returns a channel which is closed when the server says that
+// it will soon close the connection. See TransportGoingAway.
+func (c *ClientConn) GoingAway() <-chan struct{} {
+	return TransportGoingAway(c.transport)
+}
+
+// Close releases the bootstrap capability and closes the connection
+// along with its transport.
+func (c *ClientConn) Close() error {
+	c.Client.Close()
+	return c.Conn.Close()
+}
@@ -0,0 +1,28 @@
+package capngopher
+
+import (
+	"testing"
+	"time"
+)
+
+func TestClientConnWait(t *testing.T) {
+	a, b := newPipe()
+	server := NewMessageTransport(a)
+	c := NewClientConn(NewMessageTransport(b))
+	defer c.Close()
+
+	go server.goAway("restarting")
+	select {
+	case <-c.GoingAway():
+	case <-time.After(time.Second):
+		t.Fatal("no going away notice")
+	}
+
+	server.CloseWithReason(CloseServiceRestart, "restarting")
+	returnsWithin(t, time.Second, func() {
+		err := c.Wait()
+		if closeErr, ok := err.(*CloseError); !ok || closeErr.Code != CloseServiceRestart {
+			t.Errorf("Wait: %v; want close code %d", err, CloseServiceRestart)
+		}
+	})
+}
@@ -0,0 +1,186 @@
+package capngopher
+
+import (
+	"context"
+	"errors"
+	"log"
+	"time"
+
+	"zombiezen.com/go/capnproto2"
+	"zombiezen.com/go/capnproto2/rpc"
+	rpccapnp "zombiezen.com/go/capnproto2/std/capnp/rpc"
+)
+
+// A ClientHandler makes a call on a client.
+type ClientHandler func(call *capnp.Call) capnp.Answer
+
+// A ClientInterceptor runs around calls made on a client. It may alter
+// or fail the call, or make it by calling next, any number of times.
+type ClientInterceptor func(call *capnp.Call, next ClientHandler) capnp.Answer
+
+// WrapClient returns a client whose calls pass through interceptors
+// before being made on client, such as the client returned by
+// rpc.Conn.Bootstrap. The first interceptor is the outermost.
+//
+// Only calls made directly on the returned client are intercepted, not
+// calls on capabilities obtained through it.
+func WrapClient(client capnp.Client, interceptors ...ClientInterceptor) capnp.Client {
+	handler := ClientHandler(client.Call)
+	for i := len(interceptors) - 1; i >= 0; i-- {
+		handler = interceptCall(interceptors[i], handler)
+	}
+	return interceptedClient{Client: client, handler: handler}
+}
+
+func interceptCall(i ClientInterceptor, next ClientHandler) ClientHandler {
+	return func(call *capnp.Call) capnp.Answer {
+		return i(call, next)
+	}
+}
+
+type interceptedClient struct {
+	capnp.Client
+	handler ClientHandler
+}
+
+func (c interceptedClient) Call(call *capnp.Call) capnp.Answer {
+	return c.handler(call)
+}
+
+// CallTimeout cancels calls which have not returned within d. Calls
+// whose context has an earlier deadline keep it. A cancelled call is
+// finished, which cancels the context of the server method answering
+// it.
+func CallTimeout(d time.Duration) ClientInterceptor {
+	return func(call *capnp.Call, next ClientHandler) capnp.Answer {
+		ctx, cancel := context.WithTimeout(call.Ctx, d)
+		cl := *call
+		cl.Ctx = ctx
+		ans := next(&cl)
+		go func() {
+			ans.Struct()
+			cancel()
+		}()
+		return ans
+	}
+}
+
+// A RetryPolicy describes how a failed call is retried.
+type RetryPolicy struct {
+	// Attempts is the most times the call is made, including the first.
+	Attempts int
+
+	// Backoff is how long to wait before the first retry. It doubles
+	// after each retry, up to MaxBackoff if that is set.
+	Backoff    time.Duration
+	MaxBackoff time.Duration
+
+	// Retryable reports whether a call which failed with err may be
+	// retried. If it is nil, calls which fail with an overloaded or
+	// disconnected exception are retried.
+	Retryable func(err error) bool
+}
+
+// RetryMethod retries failed calls to a method according to policy. The
+// method is identified by the ID of its interface and its ordinal in
+// the schema, and should be idempotent, since a call which failed may
+// still have run. Retries stop early if the call's context is done.
+func RetryMethod(interfaceID uint64, methodID uint16, policy RetryPolicy) ClientInterceptor {
+	retryable := policy.Retryable
+	if retryable == nil {
+		retryable = isTransient
+	}
+	return func(call *capnp.Call, next ClientHandler) capnp.Answer {
+		if call.Method.InterfaceID != interfaceID || call.Method.MethodID != methodID || policy.Attempts <= 1 {
+			return next(call)
+		}
+
+		ans := &pendingAnswer{done: make(chan struct{})}
+		go func() {
+			defer close(ans.done)
+			backoff := policy.Backoff
+			for attempt := 1; ; attempt++ {
+				ans.Answer = next(call)
+				_, err := ans.Answer.Struct()
+				if err == nil || attempt >= policy.Attempts || !retryable(err) {
+					return
+				}
+
+				log.Printf("Retrying %s after %v: %v\n", call.Method.String(), backoff, err)
+				timer := time.NewTimer(backoff)
+				select {
+				case <-timer.C:
+				case <-call.Ctx.Done():
+					timer.Stop()
+					return
+				}
+				backoff *= 2
+				if policy.MaxBackoff > 0 && backoff > policy.MaxBackoff {
+					backoff = policy.MaxBackoff
+				}
+			}
+		}()
+		return ans
+	}
+}
+
+// isTransient reports whether err is an overloaded or disconnected
+// exception.
+func isTransient(err error) bool {
+	if me, ok := err.(*capnp.MethodError); ok {
+		err = me.Err
+	}
+	var e rpc.Exception
+	if !errors.As(err, &e) {
+		return false
+	}
+	return e.Type() == rpccapnp.Exception_Type_overloaded || e.Type() == rpccapnp.Exception_Type_disconnected
+}
+
+// pendingAnswer is the answer to a call which is made later, once
+// done is closed.
+type pendingAnswer struct {
+	capnp.Answer
+	done chan struct{}
+}
+
+func (a *pendingAnswer) Struct() (capnp.Struct, error) {
+	<-a.done
+	return a.Answer.Struct()
+}
+
+func (a *pendingAnswer) PipelineCall(transform []capnp.PipelineOp, call *capnp.Call) capnp.Answer {
+	<-a.done
+	return a.Answer.PipelineCall(transform, call)
+}
+
+func (a *pendingAnswer) PipelineClose(transform []capnp.PipelineOp) error {
+	<-a.done
+	return a.Answer.PipelineClose(transform)
+}
+
+// LogClientCalls logs each call made on a client once it has returned,
+// with how long it took and any error.
+func LogClientCalls() ClientInterceptor {
+	return ObserveClientCalls(func(m capnp.Method, d time.Duration, err error) {
+		if err != nil {
+			log.Printf("Call %s failed after %v: %v\n", m.String(), d, err)
+		} else {
+			log.Printf("Call %s returned after %v\n", m.String(), d)
+		}
+	})
+}
+
+// ObserveClientCalls reports each call made on a client to observe once
+// it has returned, for recording latency.
+func ObserveClientCalls(observe func(m capnp.Method, d time.Duration, err error)) ClientInterceptor {
+	return func(call *capnp.Call, next ClientHandler) capnp.Answer {
+		m, start := call.Method, time.Now()
+		ans := next(call)
+		go func() {
+			_, err := ans.Struct()
+			observe(m, time.Since(start), err)
+		}()
+		return ans
+	}
+}
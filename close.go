@@ -0,0 +1,116 @@
+package capngopher
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"zombiezen.com/go/capnproto2/rpc"
+)
+
+// Close codes, as defined for websockets by RFC 6455. Applications may
+// define their own codes between 4000 and 4999.
+const (
+	CloseNormal          = 1000
+	CloseGoingAway       = 1001
+	CloseInvalidPayload  = 1007
+	ClosePolicyViolation = 1008
+	CloseMessageTooBig   = 1009
+	CloseInternalError   = 1011
+	CloseServiceRestart  = 1012
+	CloseTryAgainLater   = 1013
+)
+
+// A CloseError reports the code and reason given by a peer which closed
+// the connection.
+type CloseError struct {
+	Code   int
+	Reason string
+}
+
+func (e *CloseError) Error() string {
+	if e.Reason == "" {
+		return fmt.Sprintf("capngopher: connection closed by peer with code %d", e.Code)
+	}
+	return fmt.Sprintf("capngopher: connection closed by peer with code %d: %s", e.Code, e.Reason)
+}
+
+// A ReasonCloser is a MessageConn which can tell its peer why it is
+// being closed, such as with a websocket close frame.
+type ReasonCloser interface {
+	CloseWithReason(code int, reason string) error
+}
+
+// TransportError returns the error which closed t, looking through
+// transports which wrap it. It is a *CloseError if the peer closed the
+// connection with a close code. TransportError returns nil if t is
+// still open or does not report why it closed.
+//
+// rpc.Conn.Wait does not report why its transport closed, so clients
+// can call TransportError once Wait returns.
+func TransportError(t rpc.Transport) error {
+	var e interface {
+		Err() error
+	}
+	if findTransport(t, &e) {
+		return e.Err()
+	}
+	return nil
+}
+
+// waitErr waits for conn to close and returns why, preferring the
+// error which closed its transport t. Closes made on purpose by either
+// side are not errors.
+func waitErr(conn *rpc.Conn, t rpc.Transport) error {
+	rpcErr := conn.Wait()
+	switch err := TransportError(t); {
+	case err == nil, err == ErrTransportClosed, err == io.EOF, isNormalClose(err):
+	default:
+		return err
+	}
+	if rpcErr == rpc.ErrConnClosed {
+		return nil
+	}
+	return rpcErr
+}
+
+// isNormalClose reports whether err is a *CloseError with CloseNormal.
+func isNormalClose(err error) bool {
+	var closeErr *CloseError
+	return errors.As(err, &closeErr) && closeErr.Code == CloseNormal
+}
+
+// closeReasonSetter is implemented by transports which can send a close
+// code and reason to the peer ahead of closing.
+type closeReasonSetter interface {
+	setCloseReason(code int, reason string)
+}
+
+// goAway tells the peer that the connection will soon be closed, so
+// that it can stop making new calls. It gives up if other writes hold
+// it up for as long as closing would wait.
+func (t *MessageTransport) goAway(reason string) error {
+	return t.sendControlBy(time.Now().Add(t.drainTimeout), controlGoAway, reason)
+}
+
+// GoingAway returns a channel which is closed when the peer says that
+// it will soon close the connection, such as when a server begins to
+// shut down. Calls already made are still answered, but new calls
+// should be made on a new connection.
+func (t *MessageTransport) GoingAway() <-chan struct{} {
+	return t.goingAway
+}
+
+// TransportGoingAway returns the channel returned by t's GoingAway
+// method, looking through transports which wrap it. It returns nil,
+// which is never closed, if t does not support going away notices.
+func TransportGoingAway(t rpc.Transport) <-chan struct{} {
+	var g interface {
+		GoingAway() <-chan struct{}
+	}
+	if findTransport(t, &g) {
+		return g.GoingAway()
+	}
+	return nil
+}
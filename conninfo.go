@@ -0,0 +1,90 @@
+package capngopher
+
+import (
+	"crypto/tls"
+	"net/http"
+	"net/url"
+	"reflect"
+
+	"zombiezen.com/go/capnproto2/rpc"
+)
+
+// ConnInfo describes where an accepted connection came from. Fields
+// which do not apply to a transport are left empty.
+type ConnInfo struct {
+	// RemoteAddr is the network address of the peer.
+	RemoteAddr string
+
+	// URL, Header and Cookies are taken from the HTTP request which
+	// opened a websocket connection.
+	URL     *url.URL
+	Header  http.Header
+	Cookies []*http.Cookie
+
+	// TLS holds the state of the TLS connection the request arrived on,
+	// or nil for unencrypted connections.
+	TLS *tls.ConnectionState
+
+	// Protocol is the negotiated websocket subprotocol, if any.
+	Protocol string
+
+	// PeerID is the ID of the remote peer of a WebRTC connection.
+	PeerID string
+
+	// Principal identifies the authenticated user of the connection.
+	// Its type depends on how the connection was authenticated.
+	Principal interface{}
+}
+
+type infoTransport struct {
+	rpc.Transport
+	info ConnInfo
+}
+
+func (t *infoTransport) ConnInfo() ConnInfo {
+	return t.info
+}
+
+// Unwrap returns the transport which t wraps.
+func (t *infoTransport) Unwrap() rpc.Transport {
+	return t.Transport
+}
+
+// WithConnInfo attaches info to t so that it can be retrieved with
+// TransportInfo.
+func WithConnInfo(t rpc.Transport, info ConnInfo) rpc.Transport {
+	return &infoTransport{Transport: t, info: info}
+}
+
+// TransportInfo returns the connection info attached to t, or an empty
+// ConnInfo if t does not describe its connection.
+func TransportInfo(t rpc.Transport) ConnInfo {
+	if i, ok := t.(interface {
+		ConnInfo() ConnInfo
+	}); ok {
+		return i.ConnInfo()
+	}
+	return ConnInfo{}
+}
+
+// findTransport looks through the chain of transports wrapping t for
+// the first which implements the interface target points to, and stores
+// it in target.
+func findTransport(t rpc.Transport, target interface{}) bool {
+	v := reflect.ValueOf(target).Elem()
+	for t != nil {
+		if reflect.TypeOf(t).Implements(v.Type()) {
+			v.Set(reflect.ValueOf(t))
+			return true
+		}
+
+		u, ok := t.(interface {
+			Unwrap() rpc.Transport
+		})
+		if !ok {
+			break
+		}
+		t = u.Unwrap()
+	}
+	return false
+}
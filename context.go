@@ -0,0 +1,118 @@
+package capngopher
+
+import (
+	"context"
+	"reflect"
+	"sync"
+
+	"zombiezen.com/go/capnproto2"
+)
+
+type contextKey int
+
+const connKey contextKey = iota
+
+// NewContext returns a copy of ctx which carries c.
+func NewContext(ctx context.Context, c *Conn) context.Context {
+	return context.WithValue(ctx, connKey, c)
+}
+
+// ConnFromContext returns the connection a call was received on. Server
+// methods can use it to identify their caller.
+//
+// Calls on the bootstrap capability carry their connection, and so do
+// calls on the capabilities returned in their results, and in the
+// results of calls on those, and so on. Capabilities handed to the peer
+// any other way, such as in the parameters of calls made on the peer's
+// capabilities, do not.
+func ConnFromContext(ctx context.Context) (*Conn, bool) {
+	c, ok := ctx.Value(connKey).(*Conn)
+	return c, ok
+}
+
+// connClient attaches its connection to the context of every call made
+// on the wrapped client, and applies the server's call timeouts. The
+// capabilities returned by its calls are wrapped in turn.
+type connClient struct {
+	capnp.Client
+	conn *Conn
+}
+
+func (c connClient) Call(call *capnp.Call) capnp.Answer {
+	cl := *call
+	cl.Ctx = NewContext(call.Ctx, c.conn)
+	d := c.conn.timeouts.timeout(call.Method.InterfaceID, call.Method.MethodID)
+	if d <= 0 {
+		return &connAnswer{Answer: c.Client.Call(&cl), conn: c.conn}
+	}
+
+	ctx, cancel := context.WithTimeout(cl.Ctx, d)
+	cl.Ctx = ctx
+	ans := c.Client.Call(&cl)
+	go func() {
+		ans.Struct()
+		cancel()
+	}()
+	return &connAnswer{Answer: ans, conn: c.conn}
+}
+
+// connAnswer wraps the capabilities in the results of a call made on a
+// connClient, before the rpc.Conn sends them to the peer or resolves
+// calls pipelined on them.
+type connAnswer struct {
+	capnp.Answer
+	conn *Conn
+	once sync.Once
+}
+
+func (a *connAnswer) Struct() (capnp.Struct, error) {
+	s, err := a.Answer.Struct()
+	if err != nil {
+		return s, err
+	}
+	a.once.Do(func() {
+		if seg := s.Segment(); seg != nil {
+			caps := seg.Message().CapTable
+			for i, client := range caps {
+				caps[i] = a.conn.wrap(client)
+			}
+		}
+	})
+	return s, nil
+}
+
+// wrap returns client as a connClient for c, unless it already is one
+// or is a capability imported from a peer.
+func (c *Conn) wrap(client capnp.Client) capnp.Client {
+	if client == nil || imported(client) {
+		return client
+	}
+	if cc, ok := client.(connClient); ok && cc.conn == c {
+		return client
+	}
+	return connClient{Client: client, conn: c}
+}
+
+// importClientType is the type of the rpc package's capabilities which
+// are hosted by a peer.
+const importClientType = "zombiezen.com/go/capnproto2/rpc.importClient"
+
+// imported reports whether client is hosted by a peer. Calls on it are
+// sent to the peer, which the context does not reach, and wrapping it
+// would stop the rpc.Conn recognising it if it is sent back to the
+// peer it came from.
+func imported(client capnp.Client) bool {
+	for {
+		r, ok := client.(interface {
+			Client() capnp.Client
+		})
+		if !ok {
+			break
+		}
+		if client = r.Client(); client == nil {
+			return false
+		}
+	}
+	t := reflect.TypeOf(client)
+	return t.Kind() == reflect.Ptr && t.Elem().PkgPath()+"."+t.Elem().Name() == importClientType
+}
@@ -0,0 +1,135 @@
+package capngopher
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"zombiezen.com/go/capnproto2"
+	"zombiezen.com/go/capnproto2/rpc"
+	"zombiezen.com/go/capnproto2/server"
+
+	"github.com/kothar/capngopher/example/service"
+)
+
+// connPinger reports the connection each ping was received on.
+type connPinger struct {
+	conns chan *Conn
+}
+
+func (s connPinger) Ping(p service.Pinger_ping) error {
+	c, _ := ConnFromContext(p.Ctx)
+	s.conns <- c
+	return p.Results.SetMsg("pong")
+}
+
+// getMethod returns the capability in its params, or a new Pinger if
+// there is none.
+var getMethod = capnp.Method{InterfaceID: 0xf00d, MethodID: 0, InterfaceName: "Getter", MethodName: "get"}
+
+// newGetter returns a client whose get method returns a capability,
+// reporting whether any capability it was given would be left
+// unwrapped.
+func newGetter(pinger service.Pinger_Server, unwrapped chan bool) capnp.Client {
+	return server.New([]server.Method{{
+		Method:      getMethod,
+		ResultsSize: capnp.ObjectSize{PointerCount: 1},
+		Impl: func(ctx context.Context, options capnp.CallOptions, params, results capnp.Struct) error {
+			var client capnp.Client
+			if p, err := params.Ptr(0); err == nil && p.Interface().IsValid() {
+				client = p.Interface().Client()
+				c, _ := ConnFromContext(ctx)
+				unwrapped <- c.wrap(client) == client
+			} else {
+				client = service.Pinger_ServerToClient(pinger).Client
+			}
+			msg := results.Segment().Message()
+			return results.SetPtr(0, capnp.NewInterface(results.Segment(), msg.AddCap(client)).ToPtr())
+		},
+	}}, nil)
+}
+
+// get calls the get method of client, passing it param if it is not
+// nil.
+func get(ctx context.Context, client, param capnp.Client) capnp.Answer {
+	return client.Call(&capnp.Call{
+		Ctx:        ctx,
+		Method:     getMethod,
+		ParamsSize: capnp.ObjectSize{PointerCount: 1},
+		ParamsFunc: func(s capnp.Struct) error {
+			if param == nil {
+				return nil
+			}
+			msg := s.Segment().Message()
+			return s.SetPtr(0, capnp.NewInterface(s.Segment(), msg.AddCap(param)).ToPtr())
+		},
+	})
+}
+
+func TestConnFromContextReturnedCapability(t *testing.T) {
+	impl := connPinger{conns: make(chan *Conn, 1)}
+	srv, tr := serveClientOnPipe(func() capnp.Client {
+		return newGetter(impl, nil)
+	})
+	c := rpc.NewConn(tr)
+	defer c.Close()
+	ctx := context.Background()
+	getter := c.Bootstrap(ctx)
+	want := srv.Conns()[0]
+
+	// Pipelined on the call which returns it
+	p := service.Pinger{Client: capnp.NewPipeline(get(ctx, getter, nil)).GetPipeline(0).Client()}
+	if err := ping(ctx, p); err != nil {
+		t.Fatal(err)
+	}
+	if got := <-impl.conns; got != want {
+		t.Errorf("pipelined call received on %v; want %v", got, want)
+	}
+
+	// Once the call has returned
+	results, err := get(ctx, getter, nil).Struct()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ptr, err := results.Ptr(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p = service.Pinger{Client: ptr.Interface().Client()}
+	if err := ping(ctx, p); err != nil {
+		t.Fatal(err)
+	}
+	if got := <-impl.conns; got != want {
+		t.Errorf("call received on %v; want %v", got, want)
+	}
+}
+
+func TestImportedCapabilityNotWrapped(t *testing.T) {
+	unwrapped := make(chan bool, 1)
+	_, tr := serveClientOnPipe(func() capnp.Client {
+		return newGetter(nil, unwrapped)
+	})
+	c := rpc.NewConn(tr)
+	defer c.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	// The peer's own capability is sent back as it is, rather than as a
+	// new capability which forwards calls to it.
+	impl := connPinger{conns: make(chan *Conn, 1)}
+	local := service.Pinger_ServerToClient(impl).Client
+	results, err := get(ctx, c.Bootstrap(ctx), local).Struct()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !<-unwrapped {
+		t.Error("capability from the peer wrapped")
+	}
+	ptr, err := results.Ptr(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ping(ctx, service.Pinger{Client: ptr.Interface().Client()}); err != nil {
+		t.Fatal(err)
+	}
+}
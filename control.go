@@ -0,0 +1,145 @@
+package capngopher
+
+import (
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// A ControlConn is a MessageConn which can carry control messages, such
+// as keepalive pings, alongside Cap'n Proto messages. Websocket
+// connections send control messages as text frames and Cap'n Proto
+// messages as binary frames.
+//
+// A MessageTransport handles control messages itself when its
+// connection is a ControlConn, unless WithoutControlMessages is given.
+type ControlConn interface {
+	MessageConn
+
+	// ReadFrame is like ReadMessage, but also returns control messages,
+	// reporting which kind of message was read.
+	ReadFrame() (p []byte, control bool, err error)
+
+	// WriteControl sends p as a control message.
+	WriteControl(p []byte) error
+}
+
+// Control messages are text of the form "<kind> <argument>".
+const (
+	controlPing   = "ping"
+	controlPong   = "pong"
+	controlClose  = "close"
+	controlGoAway = "goaway"
+)
+
+// WithoutControlMessages stops the transport sending control messages,
+// and treats any it receives as noise to be discarded, for peers which
+// do not understand them.
+func WithoutControlMessages() TransportOption {
+	return func(t *MessageTransport) {
+		t.noControl = true
+	}
+}
+
+// controlConn returns the transport's connection if control messages
+// can be sent on it.
+func (t *MessageTransport) controlConn() (ControlConn, bool) {
+	cc, ok := t.conn.(ControlConn)
+	return cc, ok && !t.noControl
+}
+
+func (t *MessageTransport) sendControl(kind, arg string) error {
+	return t.sendControlBy(time.Time{}, kind, arg)
+}
+
+// sendControlBy sends a control message, failing if other writes hold
+// it up past deadline. A zero deadline waits for as long as it takes.
+func (t *MessageTransport) sendControlBy(deadline time.Time, kind, arg string) error {
+	cc, ok := t.controlConn()
+	if !ok {
+		return nil
+	}
+
+	if !t.lockWrites(deadline) {
+		return errWriteTimeout
+	}
+	defer t.unlockWrites()
+	return cc.WriteControl([]byte(kind + " " + arg))
+}
+
+// pong answers a ping from outside the read loop, so that a write held
+// up by a peer which is not reading does not stop the transport
+// receiving too. Pings which arrive while a pong is waiting to be sent
+// are answered by that pong, which carries the latest ping's argument.
+func (t *MessageTransport) pong(arg string) {
+	t.pongMu.Lock()
+	pending := t.pongPending
+	t.pongPending, t.pongArg = true, arg
+	t.pongMu.Unlock()
+	if pending {
+		return
+	}
+
+	go func() {
+		cc, ok := t.controlConn()
+		if !ok {
+			return
+		}
+		t.lockWrites(time.Time{})
+		defer t.unlockWrites()
+
+		t.pongMu.Lock()
+		arg := t.pongArg
+		t.pongPending = false
+		t.pongMu.Unlock()
+		cc.WriteControl([]byte(controlPong + " " + arg))
+	}()
+}
+
+// handleControl acts on a control message received from the peer.
+// Unknown kinds are ignored so that peers can add new ones.
+func (t *MessageTransport) handleControl(p []byte) {
+	parts := strings.SplitN(string(p), " ", 2)
+	kind, arg := parts[0], ""
+	if len(parts) == 2 {
+		arg = parts[1]
+	}
+
+	switch kind {
+	case controlPing:
+		t.pong(arg)
+	case controlPong:
+		seq, err := strconv.ParseUint(arg, 10, 64)
+		if err != nil {
+			return
+		}
+		t.pingMu.Lock()
+		if seq == t.pingSeq {
+			atomic.StoreInt64(&t.rtt, int64(time.Since(t.pingSent)))
+		}
+		t.pingMu.Unlock()
+	case controlGoAway:
+		t.goAwayOnce.Do(func() {
+			close(t.goingAway)
+		})
+	case controlClose:
+		parts := strings.SplitN(arg, " ", 2)
+		code, err := strconv.Atoi(parts[0])
+		if err != nil {
+			return
+		}
+		closeErr := &CloseError{Code: code}
+		if len(parts) == 2 {
+			closeErr.Reason = parts[1]
+		}
+		t.fail(closeErr)
+
+		// Echo the code when closing in reply.
+		t.mu.Lock()
+		if t.closeCode == 0 {
+			t.closeCode = code
+		}
+		t.mu.Unlock()
+	}
+}
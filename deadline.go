@@ -0,0 +1,50 @@
+package capngopher
+
+import (
+	"time"
+)
+
+// WithCallTimeout cancels the context of each call received by the
+// server once it has run for d, unless WithMethodTimeout sets a timeout
+// for its method. The caller receives whatever the server method
+// returns once its context is cancelled. Timeouts apply to the calls
+// which carry their connection; see ConnFromContext.
+//
+// Callers' own deadlines need no configuring: when a call's context is
+// done the rpc.Conn making it sends a Finish message, which cancels the
+// context of the server method.
+func WithCallTimeout(d time.Duration) ServerOption {
+	return func(s *Server) {
+		s.timeouts.call = d
+	}
+}
+
+// WithMethodTimeout cancels the context of calls to a method once they
+// have run for d. Methods are identified by the ID of their interface,
+// such as service.Pinger_TypeID, and their ordinal in the schema.
+func WithMethodTimeout(interfaceID uint64, methodID uint16, d time.Duration) ServerOption {
+	return func(s *Server) {
+		if s.timeouts.methods == nil {
+			s.timeouts.methods = make(map[methodKey]time.Duration)
+		}
+		s.timeouts.methods[methodKey{interfaceID, methodID}] = d
+	}
+}
+
+type methodKey struct {
+	interfaceID uint64
+	methodID    uint16
+}
+
+// callTimeouts are the longest calls received by a server may run for.
+type callTimeouts struct {
+	call    time.Duration
+	methods map[methodKey]time.Duration
+}
+
+func (c callTimeouts) timeout(interfaceID uint64, methodID uint16) time.Duration {
+	if d, ok := c.methods[methodKey{interfaceID, methodID}]; ok {
+		return d
+	}
+	return c.call
+}
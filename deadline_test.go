@@ -0,0 +1,61 @@
+package capngopher
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"zombiezen.com/go/capnproto2/rpc"
+
+	"github.com/kothar/capngopher/example/service"
+)
+
+// cancelledPinger waits for each ping's context to be done, and reports
+// how long that took.
+type cancelledPinger struct {
+	done chan time.Duration
+}
+
+func (s cancelledPinger) Ping(p service.Pinger_ping) error {
+	start := time.Now()
+	select {
+	case <-p.Ctx.Done():
+	case <-time.After(5 * time.Second):
+	}
+	s.done <- time.Since(start)
+	return p.Ctx.Err()
+}
+
+func TestCallerDeadline(t *testing.T) {
+	impl := cancelledPinger{done: make(chan time.Duration, 1)}
+	_, tr := serveOnPipe(impl)
+	c := rpc.NewConn(tr)
+	defer c.Close()
+	p := service.Pinger{Client: c.Bootstrap(context.Background())}
+
+	for i := 0; i < 3; i++ {
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		if err := ping(ctx, p); err == nil {
+			t.Error("ping succeeded after its deadline")
+		}
+		cancel()
+		if d := <-impl.done; d > time.Second {
+			t.Errorf("server method ran for %v after the caller's deadline", d)
+		}
+	}
+}
+
+func TestMethodTimeout(t *testing.T) {
+	impl := cancelledPinger{done: make(chan time.Duration, 1)}
+	_, tr := serveOnPipe(impl, WithCallTimeout(time.Hour), WithMethodTimeout(service.Pinger_TypeID, 0, 50*time.Millisecond))
+	c := rpc.NewConn(tr)
+	defer c.Close()
+	p := service.Pinger{Client: c.Bootstrap(context.Background())}
+
+	if err := ping(context.Background(), p); err == nil {
+		t.Error("ping succeeded after its timeout")
+	}
+	if d := <-impl.done; d > time.Second {
+		t.Errorf("server method ran for %v; want 50ms", d)
+	}
+}
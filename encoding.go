@@ -0,0 +1,169 @@
+package capngopher
+
+import (
+	"bytes"
+	"compress/flate"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+
+	"zombiezen.com/go/capnproto2"
+)
+
+// An Encoding is a way of serializing messages on a MessageTransport.
+type Encoding int
+
+const (
+	// EncodingPlain uses the standard Cap'n Proto serialization.
+	EncodingPlain Encoding = iota
+
+	// EncodingPacked uses the packed Cap'n Proto serialization, which
+	// compresses runs of zero bytes.
+	EncodingPacked
+
+	// EncodingDeflate compresses each message in the standard
+	// serialization with DEFLATE.
+	EncodingDeflate
+)
+
+func (e Encoding) String() string {
+	switch e {
+	case EncodingPlain:
+		return "plain"
+	case EncodingPacked:
+		return "packed"
+	case EncodingDeflate:
+		return "deflate"
+	default:
+		return fmt.Sprintf("Encoding(%d)", int(e))
+	}
+}
+
+// codec encodes and decodes messages. Encoding and decoding may happen
+// concurrently, but only one message is encoded or decoded at a time.
+type codec struct {
+	encoding      Encoding
+	maxSize       int
+	maxSegments   int
+	traverseLimit uint64
+}
+
+// The DEFLATE compressors and decompressors are borrowed for each
+// message rather than kept by each transport, since a compressor holds
+// about a megabyte.
+var (
+	flateWriters = sync.Pool{New: func() interface{} {
+		w, _ := flate.NewWriter(nil, flate.DefaultCompression)
+		return w
+	}}
+	flateReaders = sync.Pool{New: func() interface{} {
+		return flate.NewReader(nil)
+	}}
+)
+
+func (c *codec) encode(msg *capnp.Message) ([]byte, error) {
+	switch c.encoding {
+	case EncodingPacked:
+		return msg.MarshalPacked()
+	case EncodingDeflate:
+		data, err := msg.Marshal()
+		if err != nil {
+			return nil, err
+		}
+
+		var buf bytes.Buffer
+		fw := flateWriters.Get().(*flate.Writer)
+		defer flateWriters.Put(fw)
+		fw.Reset(&buf)
+		if _, err := fw.Write(data); err != nil {
+			return nil, err
+		}
+		if err := fw.Close(); err != nil {
+			return nil, err
+		}
+		return buf.Bytes(), nil
+	default:
+		return msg.Marshal()
+	}
+}
+
+func (c *codec) decode(data []byte) (*capnp.Message, error) {
+	if len(data) > c.maxSize {
+		return nil, &LimitError{Limit: "size", Value: len(data), Max: c.maxSize}
+	}
+
+	var dec *capnp.Decoder
+	switch c.encoding {
+	case EncodingPacked:
+		dec = capnp.NewPackedDecoder(bytes.NewReader(data))
+	case EncodingDeflate:
+		fr := flateReaders.Get().(io.ReadCloser)
+		defer flateReaders.Put(fr)
+		fr.(flate.Resetter).Reset(bytes.NewReader(data), nil)
+		dec = capnp.NewDecoder(fr)
+	default:
+		dec = capnp.NewDecoder(bytes.NewReader(data))
+	}
+
+	// The decoder limits the size of the decompressed message.
+	dec.MaxMessageSize = uint64(c.maxSize)
+	msg, err := dec.Decode()
+	if err != nil {
+		return nil, err
+	}
+
+	if n := int(msg.NumSegments()); c.maxSegments > 0 && n > c.maxSegments {
+		return nil, &LimitError{Limit: "segment count", Value: n, Max: c.maxSegments}
+	}
+	if c.traverseLimit > 0 {
+		// Decoding has already started the message's read limiter.
+		msg.TraverseLimit = c.traverseLimit
+		msg.ReadLimiter().Reset(c.traverseLimit)
+
+		// The rpc package copies the messages it keeps, losing the
+		// limit, so the whole message is read here instead.
+		root, err := msg.RootPtr()
+		if err == nil {
+			err = traverse(root)
+		}
+		if err != nil {
+			if strings.Contains(err.Error(), "traversal limit") {
+				return nil, &LimitError{Limit: "traversal", Max: int(c.traverseLimit)}
+			}
+			return nil, err
+		}
+	}
+	return msg, nil
+}
+
+// traverse reads every object reachable from p, charging the message's
+// read limiter for each.
+func traverse(p capnp.Ptr) error {
+	if s := p.Struct(); s.IsValid() {
+		return traverseStruct(s)
+	}
+	l := p.List()
+	if !l.IsValid() || l.Len() == 0 || l.Struct(0).Size().PointerCount == 0 {
+		return nil
+	}
+	for i := 0; i < l.Len(); i++ {
+		if err := traverseStruct(l.Struct(i)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func traverseStruct(s capnp.Struct) error {
+	for i := uint16(0); i < s.Size().PointerCount; i++ {
+		p, err := s.Ptr(i)
+		if err != nil {
+			return err
+		}
+		if err := traverse(p); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,37 @@
+package capngopher
+
+import (
+	"bytes"
+	"sync"
+	"testing"
+)
+
+func TestDeflateConcurrent(t *testing.T) {
+	c := &codec{encoding: EncodingDeflate, maxSize: DefaultMaxMessageSize}
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i uint32) {
+			defer wg.Done()
+			msg := newCall(t, i, -1)
+			data, err := c.encode(msg.Struct.Segment().Message())
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			want, _ := msg.Struct.Segment().Message().Marshal()
+			if len(data) >= len(want) {
+				t.Errorf("compressed to %d bytes from %d", len(data), len(want))
+			}
+			decoded, err := c.decode(data)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			if got, _ := decoded.Marshal(); !bytes.Equal(got, want) {
+				t.Errorf("message %d changed by encoding", i)
+			}
+		}(uint32(i))
+	}
+	wg.Wait()
+}
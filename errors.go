@@ -0,0 +1,64 @@
+package capngopher
+
+import (
+	"errors"
+	"fmt"
+
+	"zombiezen.com/go/capnproto2"
+	"zombiezen.com/go/capnproto2/rpc"
+	rpccapnp "zombiezen.com/go/capnproto2/std/capnp/rpc"
+)
+
+// ErrListenerClosed is returned by a listener's Accept methods once the
+// listener has been closed.
+var ErrListenerClosed = errors.New("capngopher: listener closed")
+
+// ErrTransportClosed is returned when receiving on a transport which has
+// been closed.
+var ErrTransportClosed = errors.New("capngopher: transport closed")
+
+// ErrIdleTimeout is returned when receiving on a transport which was
+// closed because nothing was received from the peer within its idle
+// timeout.
+var ErrIdleTimeout = errors.New("capngopher: idle timeout")
+
+// ErrSendQueueFull is the reason a transport was closed, or a call
+// failed, because the transport's send queue was full. See
+// WithSendQueue.
+var ErrSendQueueFull = errors.New("capngopher: send queue full")
+
+// ErrTooManyExports is the reason a connection was aborted for holding
+// more capabilities than allowed by WithMaxExports.
+var ErrTooManyExports = errors.New("capngopher: too many capabilities exported")
+
+// ErrPermissionDenied is returned by calls refused by Authorize.
+var ErrPermissionDenied = errors.New("capngopher: permission denied")
+
+// IsOverloaded reports whether err is an overloaded exception, which a
+// call fails with when it is refused by a server's quotas or a full
+// send queue. Such calls were not run, and may be retried later.
+func IsOverloaded(err error) bool {
+	if me, ok := err.(*capnp.MethodError); ok {
+		err = me.Err
+	}
+	var e rpc.Exception
+	return errors.As(err, &e) && e.Type() == rpccapnp.Exception_Type_overloaded
+}
+
+// A LimitError reports a received message which exceeded one of a
+// transport's limits. The transport is closed when it is returned.
+type LimitError struct {
+	Limit string
+
+	// Value is the message's value for the limit, or zero if it is not
+	// known.
+	Value int
+	Max   int
+}
+
+func (e *LimitError) Error() string {
+	if e.Value == 0 {
+		return fmt.Sprintf("capngopher: message %s exceeds limit of %d", e.Limit, e.Max)
+	}
+	return fmt.Sprintf("capngopher: message %s of %d exceeds limit of %d", e.Limit, e.Value, e.Max)
+}
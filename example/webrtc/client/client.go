@@ -9,8 +9,9 @@ import (
 
 	"bitbucket.org/mikehouston/webconsole"
 	"github.com/PalmStoneGames/gopherjs-net-http"
-	"zombiezen.com/go/capnproto2/rpc"
+	"zombiezen.com/go/capnproto2"
 
+	"github.com/kothar/capngopher"
 	"github.com/kothar/capngopher/example/service"
 	"github.com/kothar/capngopher/webrtc"
 )
@@ -47,23 +48,6 @@ func requestPeers(id string) (map[string]time.Time, error) {
 	return peers, nil
 }
 
-func serve(s *service.PingerServer, l *webrtc.PeerListener) {
-	for {
-		t, err := l.Accept()
-		if err != nil {
-			log.Println(err)
-			continue
-		}
-		log.Println("Received connection, starting server")
-
-		// Create a new locally implemented Pinger.
-		main := service.Pinger_ServerToClient(s)
-
-		// Listen for calls, using the Pinger as the bootstrap interface.
-		rpc.NewConn(t, rpc.MainInterface(main.Client))
-	}
-}
-
 func main() {
 	// Get the current host
 	// location := js.Global.Get("window").Get("location")
@@ -84,7 +68,15 @@ func main() {
 	if err != nil {
 		log.Fatal(err)
 	}
-	go serve(s, l)
+	srv := capngopher.NewServer(l, func(info capngopher.ConnInfo) capnp.Client {
+		// Create a new locally implemented Pinger for each connection.
+		return service.Pinger_ServerToClient(s).Client
+	})
+	go func() {
+		if err := srv.Serve(); err != nil && err != capngopher.ErrListenerClosed {
+			log.Println(err)
+		}
+	}()
 
 	id, err := peer.ID()
 	if err != nil {
@@ -105,16 +97,14 @@ func main() {
 			continue
 		}
 
-		t, err := peer.Connect(remote)
+		conn, err := peer.ConnectClient(remote, nil)
 		if err != nil {
 			log.Fatal(err)
 		}
-
-		conn := rpc.NewConn(t)
 		defer conn.Close()
 
 		ctx := context.Background()
-		pinger := service.Pinger{Client: conn.Bootstrap(ctx)}
+		pinger := service.Pinger{Client: conn.Client}
 
 		log.Println("Sending ping")
 		response, err := pinger.Ping(ctx, func(p service.Pinger_ping_Params) error {
@@ -5,13 +5,13 @@ import (
 	"log"
 
 	"github.com/gopherjs/gopherjs/js"
-	"zombiezen.com/go/capnproto2/rpc"
 
 	"time"
 
+	"bitbucket.org/mikehouston/webconsole"
+	"github.com/kothar/capngopher"
 	"github.com/kothar/capngopher/example/service"
 	"github.com/kothar/capngopher/ws/client"
-	"bitbucket.org/mikehouston/webconsole"
 )
 
 func init() {
@@ -32,16 +32,21 @@ func main() {
 	}
 
 	log.Println("Connecting to websocket")
-	t, err := client.Dial(path)
+	ctx := context.Background()
+	conn, err := client.DialClient(ctx, path)
 	if err != nil {
 		log.Fatal(err)
 	}
-
-	conn := rpc.NewConn(t)
 	defer conn.Close()
 
-	ctx := context.Background()
-	pinger := service.Pinger{Client: conn.Bootstrap(ctx)}
+	pinger := service.Pinger{Client: capngopher.WrapClient(conn.Client,
+		capngopher.LogClientCalls(),
+		capngopher.RetryMethod(service.Pinger_TypeID, 0, capngopher.RetryPolicy{
+			Attempts: 3,
+			Backoff:  100 * time.Millisecond,
+		}),
+		capngopher.CallTimeout(5*time.Second),
+	)}
 
 	response, err := pinger.Ping(ctx, func(p service.Pinger_ping_Params) error {
 		p.SetMsg("Hello World over websockets")
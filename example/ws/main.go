@@ -1,47 +1,41 @@
 package main
 
 import (
+	"context"
 	"log"
 	"net/http"
+	"os"
+	"os/signal"
+	"time"
 
-	"golang.org/x/net/websocket"
-	"zombiezen.com/go/capnproto2/rpc"
+	"zombiezen.com/go/capnproto2"
 
+	"github.com/kothar/capngopher"
 	"github.com/kothar/capngopher/example/service"
 	"github.com/kothar/capngopher/ws/server"
 )
 
-func serve(s *service.PingerServer, listener *server.WebsocketListener) {
-	for {
-		t, err := listener.Accept()
-		if err != nil {
-			log.Println(err)
-			return
-		}
-
-		// Create a new locally implemented Pinger.
-		main := service.Pinger_ServerToClient(s)
-
-		// Listen for calls, using the Pinger as the bootstrap interface.
-		conn := rpc.NewConn(t, rpc.MainInterface(main.Client))
-
-		// Wait for connection to abort.
-		err = conn.Wait()
-		if err != nil {
-			log.Println(err)
-		}
-	}
-}
-
 func main() {
 	// Init websocket listener
 	listener := server.NewListener()
 
 	s := &service.PingerServer{}
-	go serve(s, listener)
+	srv := capngopher.NewServer(listener, func(info capngopher.ConnInfo) capnp.Client {
+		// Create a new locally implemented Pinger for each connection,
+		// logging its calls and recovering from panics.
+		return capngopher.Wrap(service.Pinger_Methods(nil, s),
+			capngopher.LogCalls(),
+			capngopher.RecoverPanics(),
+		)
+	})
+	go func() {
+		if err := srv.Serve(); err != nil && err != capngopher.ErrListenerClosed {
+			log.Println(err)
+		}
+	}()
 
 	// Set up HTTP handlers
-	http.Handle("/ws", websocket.Handler(listener.Handler))
+	http.Handle("/ws", listener)
 	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
 		http.ServeFile(w, r, "www/index.html")
 	})
@@ -49,9 +43,28 @@ func main() {
 		http.ServeFile(w, r, "www/client.js")
 	})
 
-	listen := "0.0.0.0:8081"
-	log.Printf("Serving on http://%s\n", listen)
-	if err := http.ListenAndServe(listen, nil); err != nil {
+	// Shut down gracefully on interrupt
+	httpServer := &http.Server{Addr: "0.0.0.0:8081"}
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+
+		interrupt := make(chan os.Signal, 1)
+		signal.Notify(interrupt, os.Interrupt)
+		<-interrupt
+
+		log.Println("Shutting down")
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		httpServer.Shutdown(ctx)
+		if err := srv.Shutdown(ctx); err != nil {
+			log.Println(err)
+		}
+	}()
+
+	log.Printf("Serving on http://%s\n", httpServer.Addr)
+	if err := httpServer.ListenAndServe(); err != nil && err != http.ErrServerClosed {
 		panic("ListenAndServe: " + err.Error())
 	}
+	<-stopped
 }
@@ -0,0 +1,144 @@
+package capngopher
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"runtime/debug"
+	"time"
+
+	"zombiezen.com/go/capnproto2"
+	"zombiezen.com/go/capnproto2/server"
+)
+
+// A ServerCall is a call to a method of a server, as seen by a
+// ServerInterceptor.
+type ServerCall struct {
+	Method  capnp.Method
+	Options capnp.CallOptions
+	Params  capnp.Struct
+	Results capnp.Struct
+}
+
+// A ServerHandler runs a call to a server method.
+type ServerHandler func(ctx context.Context, call *ServerCall) error
+
+// A ServerInterceptor runs around calls to server methods. It may
+// inspect or refuse the call, or run it by calling next.
+type ServerInterceptor func(ctx context.Context, call *ServerCall, next ServerHandler) error
+
+// Wrap returns a client for a server implemented by methods, such as
+// those returned by a generated Pinger_Methods function, whose calls
+// pass through interceptors. The first interceptor is the outermost.
+//
+// Use WrapMethods with server.New instead if the server needs to be
+// closed along with the client.
+func Wrap(methods []server.Method, interceptors ...ServerInterceptor) capnp.Client {
+	return server.New(WrapMethods(methods, interceptors...), nil)
+}
+
+// WrapMethods returns copies of methods whose calls pass through
+// interceptors. The first interceptor is the outermost.
+func WrapMethods(methods []server.Method, interceptors ...ServerInterceptor) []server.Method {
+	wrapped := make([]server.Method, len(methods))
+	for i, m := range methods {
+		impl := m.Impl
+		handler := ServerHandler(func(ctx context.Context, call *ServerCall) error {
+			return impl(ctx, call.Options, call.Params, call.Results)
+		})
+		for j := len(interceptors) - 1; j >= 0; j-- {
+			handler = intercept(interceptors[j], handler)
+		}
+
+		method := m.Method
+		m.Impl = func(ctx context.Context, options capnp.CallOptions, params, results capnp.Struct) error {
+			return handler(ctx, &ServerCall{
+				Method:  method,
+				Options: options,
+				Params:  params,
+				Results: results,
+			})
+		}
+		wrapped[i] = m
+	}
+	return wrapped
+}
+
+func intercept(i ServerInterceptor, next ServerHandler) ServerHandler {
+	return func(ctx context.Context, call *ServerCall) error {
+		return i(ctx, call, next)
+	}
+}
+
+// RecoverPanics turns a panic in a server method into an error returned
+// to the caller, instead of crashing the process. The panic is logged
+// along with its stack trace.
+func RecoverPanics() ServerInterceptor {
+	return func(ctx context.Context, call *ServerCall, next ServerHandler) (err error) {
+		defer func() {
+			if v := recover(); v != nil {
+				log.Printf("Panic in %s: %v\n%s", call.Method.String(), v, debug.Stack())
+				err = fmt.Errorf("capngopher: panic in %s", call.Method.String())
+			}
+		}()
+		return next(ctx, call)
+	}
+}
+
+// LogCalls logs each call to a server method once it has returned,
+// with the connection it was received on if its context carries one,
+// how long it took and any error.
+func LogCalls() ServerInterceptor {
+	return func(ctx context.Context, call *ServerCall, next ServerHandler) error {
+		start := time.Now()
+		err := next(ctx, call)
+
+		from := ""
+		if c, ok := ConnFromContext(ctx); ok {
+			from = fmt.Sprintf(" from connection %d (%s)", c.ID(), c.Info().RemoteAddr)
+		}
+		if err != nil {
+			log.Printf("Call %s%s failed after %v: %v\n", call.Method.String(), from, time.Since(start), err)
+		} else {
+			log.Printf("Call %s%s returned after %v\n", call.Method.String(), from, time.Since(start))
+		}
+		return err
+	}
+}
+
+// ObserveCalls reports each call to a server method to observe once it
+// has returned, for recording metrics.
+func ObserveCalls(observe func(ctx context.Context, m capnp.Method, d time.Duration, err error)) ServerInterceptor {
+	return func(ctx context.Context, call *ServerCall, next ServerHandler) error {
+		start := time.Now()
+		err := next(ctx, call)
+		observe(ctx, call.Method, time.Since(start), err)
+		return err
+	}
+}
+
+// Authorize refuses calls to server methods for which allow returns
+// false with ErrPermissionDenied. Methods are identified by the
+// InterfaceID and MethodID of m, and the caller's connection can be
+// found with ConnFromContext.
+func Authorize(allow func(ctx context.Context, m capnp.Method) bool) ServerInterceptor {
+	return func(ctx context.Context, call *ServerCall, next ServerHandler) error {
+		if !allow(ctx, call.Method) {
+			return ErrPermissionDenied
+		}
+		return next(ctx, call)
+	}
+}
+
+// Validate checks the parameters of calls to one method before they
+// are run. Calls whose parameters validate rejects fail with its error.
+func Validate(interfaceID uint64, methodID uint16, validate func(params capnp.Struct) error) ServerInterceptor {
+	return func(ctx context.Context, call *ServerCall, next ServerHandler) error {
+		if call.Method.InterfaceID == interfaceID && call.Method.MethodID == methodID {
+			if err := validate(call.Params); err != nil {
+				return err
+			}
+		}
+		return next(ctx, call)
+	}
+}
@@ -0,0 +1,83 @@
+package capngopher
+
+import (
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"zombiezen.com/go/capnproto2/rpc"
+)
+
+// WithKeepalive pings the peer every interval and closes the transport
+// if nothing has been received from it for timeout, so that half-open
+// connections are noticed. A timeout of zero only sends pings. The
+// timeout is checked once per interval, whether or not pings can be
+// written.
+//
+// Pings are control messages, so they are only sent on a ControlConn,
+// to a peer which understands them: see ControlConn. They are not
+// websocket ping frames, whose pongs the websocket library consumes
+// without reporting them. Transports answer pings whether or not they
+// send their own.
+func WithKeepalive(interval, timeout time.Duration) TransportOption {
+	return func(t *MessageTransport) {
+		t.keepalive = interval
+		t.idleTimeout = timeout
+	}
+}
+
+func (t *MessageTransport) keepaliveLoop() {
+	ticker := time.NewTicker(t.keepalive)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-t.closed:
+			return
+		}
+
+		lastRecv := time.Unix(0, atomic.LoadInt64(&t.lastRecv))
+		if t.idleTimeout > 0 && time.Since(lastRecv) > t.idleTimeout {
+			t.closeWith(ErrIdleTimeout, false)
+			return
+		}
+
+		// A ping can be held up behind a write to a peer which has
+		// stopped reading, so it must not hold up the idle check.
+		if atomic.CompareAndSwapInt32(&t.pinging, 0, 1) {
+			go func() {
+				t.ping()
+				atomic.StoreInt32(&t.pinging, 0)
+			}()
+		}
+	}
+}
+
+func (t *MessageTransport) ping() {
+	t.pingMu.Lock()
+	t.pingSeq++
+	t.pingSent = time.Now()
+	seq := t.pingSeq
+	t.pingMu.Unlock()
+
+	t.sendControl(controlPing, strconv.FormatUint(seq, 10))
+}
+
+// RTT returns the round-trip time of the last answered keepalive ping,
+// or zero if no ping has been answered.
+func (t *MessageTransport) RTT() time.Duration {
+	return time.Duration(atomic.LoadInt64(&t.rtt))
+}
+
+// TransportRTT returns the last round-trip time measured by t, looking
+// through transports which wrap it. It returns zero if t does not
+// measure round-trip times.
+func TransportRTT(t rpc.Transport) time.Duration {
+	var r interface {
+		RTT() time.Duration
+	}
+	if findTransport(t, &r) {
+		return r.RTT()
+	}
+	return 0
+}
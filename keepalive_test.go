@@ -0,0 +1,90 @@
+package capngopher
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	rpccapnp "zombiezen.com/go/capnproto2/std/capnp/rpc"
+)
+
+func TestIdleTimeoutStalledWrite(t *testing.T) {
+	msg, err := newAbort(rpccapnp.Exception_Type_failed, "stuck")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tr := NewMessageTransport(newStalledConn(), WithKeepalive(10*time.Millisecond, 50*time.Millisecond))
+	go tr.SendMessage(context.Background(), msg)
+
+	select {
+	case <-tr.Done():
+	case <-time.After(time.Second):
+		t.Fatal("transport not closed after idle timeout")
+	}
+	if tr.Err() != ErrIdleTimeout {
+		t.Errorf("Err() = %v; want %v", tr.Err(), ErrIdleTimeout)
+	}
+}
+
+func TestKeepaliveRTT(t *testing.T) {
+	a, b := newPipe()
+	tr := NewMessageTransport(a, WithKeepalive(10*time.Millisecond, time.Second))
+	defer tr.Close()
+	peer := NewMessageTransport(b)
+	defer peer.Close()
+
+	deadline := time.Now().Add(time.Second)
+	for tr.RTT() == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("no ping answered")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestWithoutControlMessages(t *testing.T) {
+	a, b := newPipe()
+	tr := NewMessageTransport(a, WithKeepalive(10*time.Millisecond, 0), WithoutControlMessages())
+	defer tr.Close()
+
+	// Nothing may be written to the peer, which is not reading.
+	time.Sleep(50 * time.Millisecond)
+	select {
+	case f := <-b.in:
+		t.Errorf("sent %q", f.data)
+	default:
+	}
+}
+
+func TestPingStalledWrite(t *testing.T) {
+	a, b := newPipe()
+	tr := NewMessageTransport(a, shortDrain)
+	defer tr.Close()
+
+	// The peer stops reading, so this write is stuck.
+	msg, err := newAbort(rpccapnp.Exception_Type_failed, "stuck")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go tr.SendMessage(context.Background(), msg)
+	time.Sleep(10 * time.Millisecond)
+
+	// Answering pings must not stop the transport receiving.
+	for i := 0; i < 3; i++ {
+		returnsWithin(t, time.Second, func() {
+			b.WriteControl([]byte("ping 1"))
+		})
+	}
+	data, err := newCall(t, 1, -1).Segment().Message().Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	returnsWithin(t, time.Second, func() {
+		b.WriteMessage(data)
+	})
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if msg, err := tr.RecvMessage(ctx); err != nil || msg.Which() != rpccapnp.Message_Which_call {
+		t.Errorf("RecvMessage = %v, %v; want a Call", msg.Which(), err)
+	}
+}
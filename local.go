@@ -0,0 +1,128 @@
+package capngopher
+
+import (
+	"zombiezen.com/go/capnproto2"
+	rpccapnp "zombiezen.com/go/capnproto2/std/capnp/rpc"
+)
+
+// answerLocally fails the question id, which has not been sent to the
+// peer, by receiving a Return carrying an exception as though the peer
+// had sent it. The Finish which the rpc.Conn sends in reply is not
+// passed on to the peer.
+func (t *MessageTransport) answerLocally(id uint32, typ rpccapnp.Exception_Type, reason string) error {
+	msg, err := newReturnException(id, typ, reason)
+	if err != nil {
+		return err
+	}
+
+	t.lmu.Lock()
+	t.local = append(t.local, msg)
+	t.unsent[id] = true
+	t.lmu.Unlock()
+
+	select {
+	case t.localReady <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// nextLocal returns the next message answered locally, if there is one.
+func (t *MessageTransport) nextLocal() (rpccapnp.Message, bool) {
+	t.lmu.Lock()
+	defer t.lmu.Unlock()
+	if len(t.local) == 0 {
+		return rpccapnp.Message{}, false
+	}
+	msg := t.local[0]
+	t.local = t.local[1:]
+	return msg, true
+}
+
+// unsentFinish reports whether msg finishes a question which was never
+// sent to the peer, and so must not be sent either.
+func (t *MessageTransport) unsentFinish(msg rpccapnp.Message) bool {
+	if msg.Which() != rpccapnp.Message_Which_finish {
+		return false
+	}
+	fin, err := msg.Finish()
+	if err != nil {
+		return false
+	}
+
+	t.lmu.Lock()
+	defer t.lmu.Unlock()
+	id := fin.QuestionId()
+	if !t.unsent[id] {
+		return false
+	}
+	delete(t.unsent, id)
+	return true
+}
+
+// pipelinedOnUnsent reports whether msg is a call pipelined on the
+// results of a question which was never sent to the peer, returning
+// the call's question ID.
+func (t *MessageTransport) pipelinedOnUnsent(msg rpccapnp.Message) (uint32, bool) {
+	if msg.Which() != rpccapnp.Message_Which_call {
+		return 0, false
+	}
+	call, err := msg.Call()
+	if err != nil {
+		return 0, false
+	}
+	target, err := call.Target()
+	if err != nil || target.Which() != rpccapnp.MessageTarget_Which_promisedAnswer {
+		return 0, false
+	}
+	pa, err := target.PromisedAnswer()
+	if err != nil {
+		return 0, false
+	}
+
+	t.lmu.Lock()
+	defer t.lmu.Unlock()
+	return call.QuestionId(), t.unsent[pa.QuestionId()]
+}
+
+// newReturnException creates a Return message answering question id
+// with an exception.
+func newReturnException(id uint32, typ rpccapnp.Exception_Type, reason string) (rpccapnp.Message, error) {
+	msg, err := newMessage()
+	if err != nil {
+		return msg, err
+	}
+	ret, err := msg.NewReturn()
+	if err != nil {
+		return msg, err
+	}
+	ret.SetAnswerId(id)
+	exc, err := ret.NewException()
+	if err != nil {
+		return msg, err
+	}
+	exc.SetType(typ)
+	return msg, exc.SetReason(reason)
+}
+
+// newAbort creates an Abort message carrying an exception.
+func newAbort(typ rpccapnp.Exception_Type, reason string) (rpccapnp.Message, error) {
+	msg, err := newMessage()
+	if err != nil {
+		return msg, err
+	}
+	exc, err := msg.NewAbort()
+	if err != nil {
+		return msg, err
+	}
+	exc.SetType(typ)
+	return msg, exc.SetReason(reason)
+}
+
+func newMessage() (rpccapnp.Message, error) {
+	_, seg, err := capnp.NewMessage(capnp.SingleSegment(nil))
+	if err != nil {
+		return rpccapnp.Message{}, err
+	}
+	return rpccapnp.NewRootMessage(seg)
+}
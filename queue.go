@@ -0,0 +1,245 @@
+package capngopher
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"zombiezen.com/go/capnproto2/rpc"
+	rpccapnp "zombiezen.com/go/capnproto2/std/capnp/rpc"
+)
+
+// defaultDrainTimeout is how long closing a transport waits for its
+// send queue and close code to be written.
+const defaultDrainTimeout = 5 * time.Second
+
+// A QueuePolicy decides what a transport does with a message when its
+// send queue is full.
+type QueuePolicy int
+
+const (
+	// QueueBlock waits for the queue to have room for the message. The
+	// rpc.Conn sending it stops sending any other messages meanwhile.
+	QueueBlock QueuePolicy = iota
+
+	// QueueDisconnect closes the transport, so that a peer which has
+	// stopped reading does not hold up the sender.
+	QueueDisconnect
+
+	// QueueFail fails new calls with an overloaded exception, which
+	// callers may retry, instead of sending them. Calls pipelined on a
+	// failed call fail too, however full the queue is. Other messages
+	// are queued regardless, since the peer depends on them being
+	// delivered.
+	QueueFail
+)
+
+func (p QueuePolicy) String() string {
+	switch p {
+	case QueueBlock:
+		return "block"
+	case QueueDisconnect:
+		return "disconnect"
+	case QueueFail:
+		return "fail"
+	default:
+		return fmt.Sprintf("QueuePolicy(%d)", int(p))
+	}
+}
+
+// WithSendQueue sends messages from a queue holding up to maxBytes of
+// encoded messages, so that sending does not wait for the peer to read
+// them. policy decides what happens when the queue is full. A message
+// is always queued if the queue is empty, however large it is.
+//
+// Without a send queue, each message is written before SendMessage
+// returns.
+func WithSendQueue(maxBytes int, policy QueuePolicy) TransportOption {
+	return func(t *MessageTransport) {
+		t.queue = &sendQueue{
+			maxBytes: maxBytes,
+			policy:   policy,
+			changed:  make(chan struct{}),
+			done:     make(chan struct{}),
+		}
+	}
+}
+
+// QueueStats describes a transport's send queue.
+type QueueStats struct {
+	// Messages and Bytes count the messages waiting to be written,
+	// including any being written.
+	Messages int
+	Bytes    int
+
+	// PeakBytes is the most Bytes has been.
+	PeakBytes int
+	MaxBytes  int
+
+	// Rejected counts the calls failed because the queue was full.
+	Rejected uint64
+}
+
+type sendQueue struct {
+	maxBytes int
+	policy   QueuePolicy
+
+	mu       sync.Mutex
+	msgs     [][]byte
+	bytes    int
+	peak     int
+	rejected uint64
+	changed  chan struct{} // closed and replaced whenever msgs changes
+
+	done chan struct{} // closed when writeLoop returns
+}
+
+// notify wakes everything waiting for the queue to change. The caller
+// must hold q.mu.
+func (q *sendQueue) notify() {
+	close(q.changed)
+	q.changed = make(chan struct{})
+}
+
+// enqueue adds p, the encoding of msg, to the send queue, applying the
+// queue's policy if it is full.
+func (t *MessageTransport) enqueue(ctx context.Context, msg rpccapnp.Message, p []byte) error {
+	q := t.queue
+	q.mu.Lock()
+	for q.bytes > 0 && q.bytes+len(p) > q.maxBytes {
+		if q.policy == QueueDisconnect {
+			q.mu.Unlock()
+			log.Println("Disconnecting peer which is not reading:", ErrSendQueueFull)
+			t.closeWith(ErrSendQueueFull, false)
+			return ErrSendQueueFull
+		}
+		if q.policy == QueueFail {
+			if msg.Which() != rpccapnp.Message_Which_call {
+				break
+			}
+			q.rejected++
+			q.mu.Unlock()
+			call, err := msg.Call()
+			if err != nil {
+				return err
+			}
+			return t.answerLocally(call.QuestionId(), rpccapnp.Exception_Type_overloaded, ErrSendQueueFull.Error())
+		}
+
+		changed := q.changed
+		q.mu.Unlock()
+		select {
+		case <-changed:
+		case <-t.closed:
+			return t.Err()
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		q.mu.Lock()
+	}
+
+	q.msgs = append(q.msgs, p)
+	q.bytes += len(p)
+	if q.bytes > q.peak {
+		q.peak = q.bytes
+	}
+	q.notify()
+	q.mu.Unlock()
+	return nil
+}
+
+// writeLoop writes the messages in the send queue until the transport
+// is closed.
+func (t *MessageTransport) writeLoop() {
+	q := t.queue
+	for {
+		q.mu.Lock()
+		if len(q.msgs) == 0 {
+			changed := q.changed
+			q.mu.Unlock()
+			select {
+			case <-changed:
+				continue
+			case <-t.closed:
+				close(q.done)
+				return
+			}
+		}
+		p := q.msgs[0]
+		q.mu.Unlock()
+
+		t.lockWrites(time.Time{})
+		err := t.conn.WriteMessage(p)
+		t.unlockWrites()
+
+		q.mu.Lock()
+		q.msgs[0] = nil
+		q.msgs = q.msgs[1:]
+		q.bytes -= len(p)
+		q.notify()
+		q.mu.Unlock()
+
+		if err != nil {
+			// Closing may be waiting for the queue to drain.
+			close(q.done)
+			t.closeWith(err, false)
+			return
+		}
+	}
+}
+
+// drain waits until the send queue is empty or timeout has passed.
+func (q *sendQueue) drain(timeout time.Duration) {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	for {
+		q.mu.Lock()
+		empty, changed := len(q.msgs) == 0, q.changed
+		q.mu.Unlock()
+		if empty {
+			return
+		}
+
+		select {
+		case <-changed:
+		case <-q.done:
+			return
+		case <-timer.C:
+			return
+		}
+	}
+}
+
+// QueueStats describes the transport's send queue. It returns the zero
+// QueueStats if the transport has no send queue.
+func (t *MessageTransport) QueueStats() QueueStats {
+	q := t.queue
+	if q == nil {
+		return QueueStats{}
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return QueueStats{
+		Messages:  len(q.msgs),
+		Bytes:     q.bytes,
+		PeakBytes: q.peak,
+		MaxBytes:  q.maxBytes,
+		Rejected:  q.rejected,
+	}
+}
+
+// TransportQueueStats describes the send queue of t, looking through
+// transports which wrap it. It returns the zero QueueStats if t has no
+// send queue.
+func TransportQueueStats(t rpc.Transport) QueueStats {
+	var s interface {
+		QueueStats() QueueStats
+	}
+	if findTransport(t, &s) {
+		return s.QueueStats()
+	}
+	return QueueStats{}
+}
@@ -0,0 +1,202 @@
+package capngopher
+
+import (
+	"context"
+	"io"
+	"sync"
+	"testing"
+	"time"
+
+	"zombiezen.com/go/capnproto2/rpc"
+	rpccapnp "zombiezen.com/go/capnproto2/std/capnp/rpc"
+)
+
+// gatedConn holds up writes until it is opened, then records them. It
+// never receives anything.
+type gatedConn struct {
+	open    chan struct{}
+	closed  chan struct{}
+	once    sync.Once
+	mu      sync.Mutex
+	written int
+}
+
+func newGatedConn() *gatedConn {
+	return &gatedConn{open: make(chan struct{}), closed: make(chan struct{})}
+}
+
+func (c *gatedConn) ReadMessage() ([]byte, error) {
+	<-c.closed
+	return nil, io.EOF
+}
+
+func (c *gatedConn) WriteMessage(p []byte) error {
+	select {
+	case <-c.open:
+	case <-c.closed:
+		return io.ErrClosedPipe
+	}
+	c.mu.Lock()
+	c.written++
+	c.mu.Unlock()
+	return nil
+}
+
+func (c *gatedConn) Written() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.written
+}
+
+func (c *gatedConn) Close() error {
+	c.once.Do(func() { close(c.closed) })
+	return nil
+}
+
+// newCall creates a call for question id on the bootstrap capability,
+// or pipelined on the results of question on if it is not negative.
+func newCall(t *testing.T, id uint32, on int) rpccapnp.Message {
+	msg, err := newMessage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	call, err := msg.NewCall()
+	if err != nil {
+		t.Fatal(err)
+	}
+	call.SetQuestionId(id)
+	target, err := call.NewTarget()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if on < 0 {
+		target.SetImportedCap(0)
+	} else {
+		pa, err := target.NewPromisedAnswer()
+		if err != nil {
+			t.Fatal(err)
+		}
+		pa.SetQuestionId(uint32(on))
+	}
+	return msg
+}
+
+// recvReturn receives the next message from tr, which must be a Return
+// for question id carrying an overloaded exception.
+func recvReturn(t *testing.T, tr rpc.Transport, id uint32) {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	msg, err := tr.RecvMessage(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ret, err := msg.Return()
+	if err != nil || msg.Which() != rpccapnp.Message_Which_return {
+		t.Fatalf("received %v; want a Return", msg.Which())
+	}
+	exc, err := ret.Exception()
+	if ret.AnswerId() != id || ret.Which() != rpccapnp.Return_Which_exception || err != nil || exc.Type() != rpccapnp.Exception_Type_overloaded {
+		t.Fatalf("received Return for %d of %v; want an overloaded exception for %d", ret.AnswerId(), ret.Which(), id)
+	}
+}
+
+func TestQueueBlock(t *testing.T) {
+	conn := newGatedConn()
+	tr := NewMessageTransport(conn, WithSendQueue(1, QueueBlock))
+	defer tr.Close()
+	ctx := context.Background()
+	if err := tr.SendMessage(ctx, newCall(t, 0, -1)); err != nil {
+		t.Fatal(err)
+	}
+
+	short, cancel := context.WithTimeout(ctx, 20*time.Millisecond)
+	defer cancel()
+	if err := tr.SendMessage(short, newCall(t, 1, -1)); err != context.DeadlineExceeded {
+		t.Errorf("SendMessage to full queue = %v; want %v", err, context.DeadlineExceeded)
+	}
+
+	sent := make(chan error, 1)
+	go func() {
+		sent <- tr.SendMessage(ctx, newCall(t, 2, -1))
+	}()
+	close(conn.open)
+	if err := <-sent; err != nil {
+		t.Errorf("SendMessage once queue drained: %v", err)
+	}
+}
+
+func TestQueueDisconnect(t *testing.T) {
+	conn := newGatedConn()
+	tr := NewMessageTransport(conn, WithSendQueue(1, QueueDisconnect))
+	ctx := context.Background()
+	if err := tr.SendMessage(ctx, newCall(t, 0, -1)); err != nil {
+		t.Fatal(err)
+	}
+	if err := tr.SendMessage(ctx, newCall(t, 1, -1)); err != ErrSendQueueFull {
+		t.Errorf("SendMessage to full queue = %v; want %v", err, ErrSendQueueFull)
+	}
+	if tr.Err() != ErrSendQueueFull {
+		t.Errorf("Err() = %v; want %v", tr.Err(), ErrSendQueueFull)
+	}
+}
+
+func TestQueueFail(t *testing.T) {
+	conn := newGatedConn()
+	tr := NewMessageTransport(conn, WithSendQueue(1, QueueFail))
+	defer tr.Close()
+	ctx := context.Background()
+	if err := tr.SendMessage(ctx, newCall(t, 0, -1)); err != nil {
+		t.Fatal(err)
+	}
+	if err := tr.SendMessage(ctx, newCall(t, 1, -1)); err != nil {
+		t.Fatal(err)
+	}
+	recvReturn(t, tr, 1)
+	if s := tr.QueueStats(); s.Rejected != 1 || s.Messages != 1 {
+		t.Errorf("QueueStats() = %+v; want 1 rejected and 1 queued", s)
+	}
+
+	// Once the queue has room, calls pipelined on the failed call fail
+	// too, and neither they nor its Finish reach the peer.
+	close(conn.open)
+	for tr.QueueStats().Messages > 0 {
+		time.Sleep(time.Millisecond)
+	}
+	if err := tr.SendMessage(ctx, newCall(t, 2, 1)); err != nil {
+		t.Fatal(err)
+	}
+	recvReturn(t, tr, 2)
+	for _, id := range []uint32{1, 2} {
+		fin, err := newFinish(id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := tr.SendMessage(ctx, fin); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tr.SendMessage(ctx, newCall(t, 3, 0)); err != nil {
+		t.Fatal(err)
+	}
+	for tr.QueueStats().Messages > 0 {
+		time.Sleep(time.Millisecond)
+	}
+	if n := conn.Written(); n != 2 {
+		t.Errorf("%d messages written; want 2", n)
+	}
+}
+
+// newFinish creates a Finish message for question id.
+func newFinish(id uint32) (rpccapnp.Message, error) {
+	msg, err := newMessage()
+	if err != nil {
+		return msg, err
+	}
+	fin, err := msg.NewFinish()
+	if err != nil {
+		return msg, err
+	}
+	fin.SetQuestionId(id)
+	return msg, nil
+}
@@ -0,0 +1,266 @@
+package capngopher
+
+import (
+	"context"
+	"log"
+	"sync"
+	"time"
+
+	"zombiezen.com/go/capnproto2/rpc"
+	rpccapnp "zombiezen.com/go/capnproto2/std/capnp/rpc"
+)
+
+// A ServerOption configures a Server.
+type ServerOption func(s *Server)
+
+// WithCallRate limits each connection to making n calls per period, in
+// bursts of up to n. Calls over the limit fail with an overloaded
+// exception before they reach the bootstrap capability; see
+// IsOverloaded. A period which is not positive is logged and ignored.
+func WithCallRate(n int, per time.Duration) ServerOption {
+	return func(s *Server) {
+		if per <= 0 {
+			log.Println("Ignoring call rate period:", per)
+			return
+		}
+		s.quotas.callRate = float64(n) / per.Seconds()
+		s.quotas.callBurst = n
+	}
+}
+
+// WithMaxPendingCalls limits the number of calls from each connection
+// which may be in progress at once. Further calls fail with an
+// overloaded exception until some have returned.
+func WithMaxPendingCalls(n int) ServerOption {
+	return func(s *Server) {
+		s.quotas.maxPending = n
+	}
+}
+
+// WithMaxExports limits the number of capabilities each connection may
+// hold at once. Capabilities are handed out in the results of calls
+// which have already run, so a connection which exceeds the limit is
+// aborted rather than having calls fail.
+func WithMaxExports(n int) ServerOption {
+	return func(s *Server) {
+		s.quotas.maxExports = n
+	}
+}
+
+// quotas are the limits placed on each connection to a Server.
+type quotas struct {
+	callRate   float64 // calls per second
+	callBurst  int
+	maxPending int
+	maxExports int
+}
+
+// wrap returns t, limited by q if it has any limits.
+func (q quotas) wrap(t rpc.Transport) rpc.Transport {
+	if q == (quotas{}) {
+		return t
+	}
+	return &quotaTransport{
+		Transport: t,
+		quotas:    q,
+		tokens:    float64(q.callBurst),
+		last:      time.Now(),
+		pending:   make(map[uint32]bool),
+		refused:   make(map[uint32]bool),
+		exports:   make(map[uint32]uint32),
+	}
+}
+
+// quotaTransport wraps a transport to enforce quotas on the calls
+// received from the remote vat and the capabilities exported to it.
+// Refused calls are answered by the transport itself, so the rpc.Conn
+// never sees them.
+type quotaTransport struct {
+	rpc.Transport
+	quotas
+
+	smu sync.Mutex // serializes SendMessage
+
+	mu      sync.Mutex
+	tokens  float64 // calls which may be made now
+	last    time.Time
+	pending map[uint32]bool   // calls in progress
+	refused map[uint32]bool   // refused calls awaiting a Finish
+	exports map[uint32]uint32 // reference counts of exported capabilities
+}
+
+func (t *quotaTransport) RecvMessage(ctx context.Context) (rpccapnp.Message, error) {
+	for {
+		msg, err := t.Transport.RecvMessage(ctx)
+		if err != nil {
+			return msg, err
+		}
+
+		switch msg.Which() {
+		case rpccapnp.Message_Which_call:
+			call, err := msg.Call()
+			if err != nil {
+				break
+			}
+			if reason := t.admit(call); reason != "" {
+				if err := t.refuse(ctx, call.QuestionId(), reason); err != nil {
+					return rpccapnp.Message{}, err
+				}
+				continue
+			}
+		case rpccapnp.Message_Which_finish:
+			fin, err := msg.Finish()
+			if err != nil {
+				break
+			}
+			if t.finishRefused(fin.QuestionId()) {
+				continue
+			}
+		case rpccapnp.Message_Which_release:
+			rel, err := msg.Release()
+			if err != nil {
+				break
+			}
+			t.release(rel.Id(), rel.ReferenceCount())
+		}
+		return msg, nil
+	}
+}
+
+// admit counts a call received from the peer, returning why it is
+// refused if it exceeds the connection's quotas.
+func (t *quotaTransport) admit(call rpccapnp.Call) string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if target, err := call.Target(); err == nil && target.Which() == rpccapnp.MessageTarget_Which_promisedAnswer {
+		if pa, err := target.PromisedAnswer(); err == nil && t.refused[pa.QuestionId()] {
+			return "call pipelined on a refused call"
+		}
+	}
+	if t.maxPending > 0 && len(t.pending) >= t.maxPending {
+		return "too many calls in progress"
+	}
+	if t.callRate > 0 {
+		now := time.Now()
+		t.tokens += now.Sub(t.last).Seconds() * t.callRate
+		if t.tokens > float64(t.callBurst) {
+			t.tokens = float64(t.callBurst)
+		}
+		t.last = now
+		if t.tokens < 1 {
+			return "call rate exceeded"
+		}
+		t.tokens--
+	}
+	t.pending[call.QuestionId()] = true
+	return ""
+}
+
+// refuse answers the call id with an overloaded exception. The peer's
+// Finish for the call is swallowed when it arrives.
+func (t *quotaTransport) refuse(ctx context.Context, id uint32, reason string) error {
+	t.mu.Lock()
+	t.refused[id] = true
+	t.mu.Unlock()
+
+	msg, err := newReturnException(id, rpccapnp.Exception_Type_overloaded, "capngopher: "+reason)
+	if err != nil {
+		return err
+	}
+	t.smu.Lock()
+	defer t.smu.Unlock()
+	return t.Transport.SendMessage(ctx, msg)
+}
+
+// finishRefused reports whether id is a refused call, forgetting it.
+func (t *quotaTransport) finishRefused(id uint32) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if !t.refused[id] {
+		return false
+	}
+	delete(t.refused, id)
+	return true
+}
+
+func (t *quotaTransport) release(id, count uint32) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.exports[id] <= count {
+		delete(t.exports, id)
+	} else {
+		t.exports[id] -= count
+	}
+}
+
+func (t *quotaTransport) SendMessage(ctx context.Context, msg rpccapnp.Message) error {
+	t.smu.Lock()
+	defer t.smu.Unlock()
+
+	var caps rpccapnp.CapDescriptor_List
+	switch msg.Which() {
+	case rpccapnp.Message_Which_return:
+		ret, err := msg.Return()
+		if err != nil {
+			break
+		}
+		t.mu.Lock()
+		delete(t.pending, ret.AnswerId())
+		t.mu.Unlock()
+		if ret.Which() == rpccapnp.Return_Which_results {
+			if results, err := ret.Results(); err == nil {
+				caps, _ = results.CapTable()
+			}
+		}
+	case rpccapnp.Message_Which_call:
+		if call, err := msg.Call(); err == nil {
+			if params, err := call.Params(); err == nil {
+				caps, _ = params.CapTable()
+			}
+		}
+	}
+
+	if !t.export(caps) {
+		return t.abort(ctx, ErrTooManyExports)
+	}
+	return t.Transport.SendMessage(ctx, msg)
+}
+
+// export counts the capabilities the peer will hold after receiving
+// caps, reporting false if they exceed the connection's quota.
+func (t *quotaTransport) export(caps rpccapnp.CapDescriptor_List) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for i := 0; i < caps.Len(); i++ {
+		c := caps.At(i)
+		switch c.Which() {
+		case rpccapnp.CapDescriptor_Which_senderHosted:
+			t.exports[c.SenderHosted()]++
+		case rpccapnp.CapDescriptor_Which_senderPromise:
+			t.exports[c.SenderPromise()]++
+		}
+	}
+	return t.maxExports <= 0 || len(t.exports) <= t.maxExports
+}
+
+// abort sends the peer an Abort message and closes the transport. The
+// caller must hold t.smu.
+func (t *quotaTransport) abort(ctx context.Context, err error) error {
+	log.Println("Aborting connection:", err)
+	if msg, merr := newAbort(rpccapnp.Exception_Type_overloaded, err.Error()); merr == nil {
+		t.Transport.SendMessage(ctx, msg)
+	}
+
+	var s closeReasonSetter
+	if findTransport(t.Transport, &s) {
+		s.setCloseReason(ClosePolicyViolation, err.Error())
+	}
+	t.Transport.Close()
+	return err
+}
+
+// Unwrap returns the transport which t wraps.
+func (t *quotaTransport) Unwrap() rpc.Transport {
+	return t.Transport
+}
@@ -0,0 +1,202 @@
+package capngopher
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	rpccapnp "zombiezen.com/go/capnproto2/std/capnp/rpc"
+)
+
+// quotaPipe serves a transport limited by q on one end of a pipe. The
+// messages it lets through are sent on the returned channel, and peer
+// is the other end of the pipe.
+func quotaPipe(t *testing.T, q quotas) (qt *quotaTransport, got <-chan rpccapnp.Message, peer *MessageTransport) {
+	a, b := newPipe()
+	qt = q.wrap(NewMessageTransport(a)).(*quotaTransport)
+	peer = NewMessageTransport(b)
+	ch := make(chan rpccapnp.Message)
+	go func() {
+		for {
+			msg, err := qt.RecvMessage(context.Background())
+			if err != nil {
+				close(ch)
+				return
+			}
+			ch <- msg
+		}
+	}()
+	t.Cleanup(func() {
+		qt.Close()
+		peer.Close()
+	})
+	return qt, ch, peer
+}
+
+// send sends msg from the peer, which must succeed.
+func send(t *testing.T, tr *MessageTransport, msg rpccapnp.Message) {
+	t.Helper()
+	if err := tr.SendMessage(context.Background(), msg); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// recvCall waits for the call for question id to be let through.
+func recvCall(t *testing.T, got <-chan rpccapnp.Message, id uint32) {
+	t.Helper()
+	select {
+	case msg := <-got:
+		call, err := msg.Call()
+		if err != nil || msg.Which() != rpccapnp.Message_Which_call {
+			t.Fatalf("let through %v; want a Call", msg.Which())
+		}
+		if call.QuestionId() != id {
+			t.Fatalf("let through call %d; want %d", call.QuestionId(), id)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("call %d not let through", id)
+	}
+}
+
+// newResults creates a Return for question id whose results hold the
+// exported capability capID.
+func newResults(id, capID uint32) (rpccapnp.Message, error) {
+	msg, err := newMessage()
+	if err != nil {
+		return msg, err
+	}
+	ret, err := msg.NewReturn()
+	if err != nil {
+		return msg, err
+	}
+	ret.SetAnswerId(id)
+	results, err := ret.NewResults()
+	if err != nil {
+		return msg, err
+	}
+	caps, err := results.NewCapTable(1)
+	if err != nil {
+		return msg, err
+	}
+	caps.At(0).SetSenderHosted(capID)
+	return msg, nil
+}
+
+// newRelease creates a Release message for count references to the
+// exported capability id.
+func newRelease(id, count uint32) (rpccapnp.Message, error) {
+	msg, err := newMessage()
+	if err != nil {
+		return msg, err
+	}
+	rel, err := msg.NewRelease()
+	if err != nil {
+		return msg, err
+	}
+	rel.SetId(id)
+	rel.SetReferenceCount(count)
+	return msg, nil
+}
+
+func TestQuotaMaxPending(t *testing.T) {
+	qt, got, peer := quotaPipe(t, quotas{maxPending: 1})
+	send(t, peer, newCall(t, 1, -1))
+	recvCall(t, got, 1)
+
+	send(t, peer, newCall(t, 2, -1))
+	recvReturn(t, peer, 2)
+	send(t, peer, newCall(t, 3, 2))
+	recvReturn(t, peer, 3)
+
+	// The Finishes for refused calls are swallowed, and returning the
+	// call in progress makes room for another.
+	for _, id := range []uint32{2, 3} {
+		fin, err := newFinish(id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		send(t, peer, fin)
+	}
+	ret, err := newReturnException(1, rpccapnp.Exception_Type_overloaded, "done")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := qt.SendMessage(context.Background(), ret); err != nil {
+		t.Fatal(err)
+	}
+	recvReturn(t, peer, 1)
+	send(t, peer, newCall(t, 4, -1))
+	recvCall(t, got, 4)
+}
+
+func TestQuotaCallRate(t *testing.T) {
+	_, got, peer := quotaPipe(t, quotas{callRate: 1.0 / 3600, callBurst: 2})
+	send(t, peer, newCall(t, 1, -1))
+	recvCall(t, got, 1)
+	send(t, peer, newCall(t, 2, -1))
+	recvCall(t, got, 2)
+	send(t, peer, newCall(t, 3, -1))
+	recvReturn(t, peer, 3)
+}
+
+func TestQuotaMaxExports(t *testing.T) {
+	qt, got, peer := quotaPipe(t, quotas{maxExports: 1})
+	ctx := context.Background()
+	msg, err := newResults(1, 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := qt.SendMessage(ctx, msg); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := peer.RecvMessage(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	// Once the peer releases its capability, another may be exported.
+	msg, err = newRelease(5, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	send(t, peer, msg)
+	<-got
+	msg, err = newResults(2, 6)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := qt.SendMessage(ctx, msg); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := peer.RecvMessage(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	over, err := newResults(3, 7)
+	if err != nil {
+		t.Fatal(err)
+	}
+	errs := make(chan error, 1)
+	go func() {
+		errs <- qt.SendMessage(ctx, over)
+	}()
+	msg, err = peer.RecvMessage(ctx)
+	if err != nil || msg.Which() != rpccapnp.Message_Which_abort {
+		t.Fatalf("received %v, %v; want an Abort", msg.Which(), err)
+	}
+	if _, err := peer.RecvMessage(ctx); err == nil {
+		t.Fatal("received a message after the Abort")
+	}
+	if closeErr, ok := peer.Err().(*CloseError); !ok || closeErr.Code != ClosePolicyViolation {
+		t.Errorf("peer closed with %v; want close code %d", peer.Err(), ClosePolicyViolation)
+	}
+	if err := <-errs; err != ErrTooManyExports {
+		t.Errorf("SendMessage = %v; want %v", err, ErrTooManyExports)
+	}
+}
+
+func TestWithCallRatePeriod(t *testing.T) {
+	s := NewServer(nil, nil, WithCallRate(10, 0))
+	if s.quotas != (quotas{}) {
+		t.Errorf("quotas = %+v; want none for a zero period", s.quotas)
+	}
+}
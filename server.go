@@ -0,0 +1,323 @@
+// Package capngopher serves Cap'n Proto RPC over browser-friendly
+// transports such as websockets and WebRTC data channels.
+package capngopher
+
+import (
+	"context"
+	"io"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"zombiezen.com/go/capnproto2"
+	"zombiezen.com/go/capnproto2/rpc"
+)
+
+// shutdownPollInterval is how often Shutdown looks for connections
+// which have become idle.
+const shutdownPollInterval = 100 * time.Millisecond
+
+// A Listener accepts incoming RPC transports.
+type Listener interface {
+	Accept() (rpc.Transport, error)
+}
+
+// A BootstrapFunc creates the main interface offered to a connection.
+type BootstrapFunc func(info ConnInfo) capnp.Client
+
+// A Conn is an RPC connection being served by a Server.
+type Conn struct {
+	*rpc.Conn
+
+	id       uint64
+	info     ConnInfo
+	calls    *callTracker
+	timeouts callTimeouts
+}
+
+// ID returns a number identifying the connection, unique within its
+// Server.
+func (c *Conn) ID() uint64 {
+	return c.id
+}
+
+// Info describes where the connection came from.
+func (c *Conn) Info() ConnInfo {
+	return c.info
+}
+
+// RTT returns the round-trip time last measured on the connection's
+// transport, or zero if it has not been measured. Websocket transports
+// measure it with keepalive pings.
+func (c *Conn) RTT() time.Duration {
+	return TransportRTT(c.calls)
+}
+
+// QueueStats describes the send queue of the connection's transport.
+// It returns the zero QueueStats if the transport has no send queue.
+func (c *Conn) QueueStats() QueueStats {
+	return TransportQueueStats(c.calls)
+}
+
+// CloseWithReason closes the connection, telling the peer why with a
+// close code, if the transport supports one.
+func (c *Conn) CloseWithReason(code int, reason string) error {
+	var t closeReasonSetter
+	if findTransport(c.calls, &t) {
+		t.setCloseReason(code, reason)
+	}
+	return c.Close()
+}
+
+// abandon closes the connection without waiting for the peer to read
+// what has been sent to it.
+func (c *Conn) abandon() {
+	var t interface {
+		abandon()
+	}
+	if findTransport(c.calls, &t) {
+		t.abandon()
+	}
+	c.Close()
+}
+
+// goAway tells the peer that the connection will soon be closed, if
+// the transport supports going away notices.
+func (c *Conn) goAway(reason string) {
+	var t interface {
+		goAway(reason string) error
+	}
+	if findTransport(c.calls, &t) {
+		t.goAway(reason)
+	}
+}
+
+// Wait waits until the connection is closed and returns why, unlike
+// rpc.Conn.Wait. It returns nil if either side closed the connection
+// normally, a *CloseError if the peer closed it with another close
+// code, and otherwise the error which broke the transport or the
+// connection.
+func (c *Conn) Wait() error {
+	return waitErr(c.Conn, c.calls)
+}
+
+// Idle reports whether the connection has no calls in progress.
+func (c *Conn) Idle() bool {
+	return c.calls.active() == 0
+}
+
+// Server accepts transports from a Listener and serves a bootstrap
+// capability on each of them concurrently.
+type Server struct {
+	listener  Listener
+	bootstrap BootstrapFunc
+	quotas    quotas
+	timeouts  callTimeouts
+
+	lastID uint64
+
+	mu           sync.Mutex
+	conns        map[*Conn]struct{}
+	shuttingDown bool
+}
+
+// NewServer creates a server for the transports accepted by l.
+// bootstrap is called to create the main interface each time a
+// connection asks for it, so each connection can be given its own
+// capability. options set quotas on what each connection may do.
+func NewServer(l Listener, bootstrap BootstrapFunc, options ...ServerOption) *Server {
+	s := &Server{
+		listener:  l,
+		bootstrap: bootstrap,
+		conns:     make(map[*Conn]struct{}),
+	}
+	for _, option := range options {
+		option(s)
+	}
+	return s
+}
+
+// Serve accepts transports until the listener returns an error, which
+// is then returned. Each transport is served on its own goroutine.
+// After Close or Shutdown the listener's error will usually be
+// ErrListenerClosed.
+func (s *Server) Serve() error {
+	for {
+		t, err := s.listener.Accept()
+		if err != nil {
+			return err
+		}
+		go s.ServeTransport(t)
+	}
+}
+
+// ServeTransport serves the bootstrap capability on t and blocks until
+// the connection is closed, returning the error from Conn.Wait.
+//
+// If t has a Done method, like MessageTransport, the connection is
+// closed as soon as the channel it returns is closed. The contexts of
+// calls in progress are then cancelled, so that server methods can stop
+// work for peers which have gone away.
+//
+// Calls made on the bootstrap capability, and on the capabilities it
+// returns, carry the connection in their context, which can be
+// retrieved with ConnFromContext, and are subject to the server's call
+// timeouts.
+func (s *Server) ServeTransport(t rpc.Transport) error {
+	c := &Conn{
+		id:       atomic.AddUint64(&s.lastID, 1),
+		info:     TransportInfo(t),
+		calls:    newCallTracker(s.quotas.wrap(t)),
+		timeouts: s.timeouts,
+	}
+	c.Conn = rpc.NewConn(c.calls, rpc.BootstrapFunc(func(ctx context.Context) (capnp.Client, error) {
+		return connClient{Client: s.bootstrap(c.info), conn: c}, nil
+	}))
+
+	if !s.track(c, true) {
+		return c.CloseWithReason(CloseGoingAway, "server shutting down")
+	}
+	defer s.track(c, false)
+
+	var d interface {
+		Done() <-chan struct{}
+	}
+	if findTransport(t, &d) {
+		closed := make(chan struct{})
+		defer close(closed)
+		go func() {
+			select {
+			case <-d.Done():
+				// The rpc.Conn only notices when it next receives, which
+				// may be held up, so cancel the calls in progress now.
+				c.Conn.Close()
+			case <-closed:
+			}
+		}()
+	}
+
+	err := c.Wait()
+	if err != nil {
+		log.Println("Connection closed:", err)
+	}
+	return err
+}
+
+// track adds or removes c from the set of live connections. It
+// returns false if c cannot be added because the server is shutting
+// down.
+func (s *Server) track(c *Conn, add bool) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if !add {
+		delete(s.conns, c)
+		return true
+	}
+
+	if s.shuttingDown {
+		return false
+	}
+	s.conns[c] = struct{}{}
+	return true
+}
+
+// Conns returns the connections currently being served.
+func (s *Server) Conns() []*Conn {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	conns := make([]*Conn, 0, len(s.conns))
+	for c := range s.conns {
+		conns = append(conns, c)
+	}
+	return conns
+}
+
+// Close closes the listener, if it can be closed, and every live
+// connection without waiting for calls in progress.
+func (s *Server) Close() error {
+	err := s.closeListener()
+	closeConns(s.Conns(), true)
+	return err
+}
+
+// Shutdown gracefully shuts down the server. The listener is closed
+// first so that no new connections are served, and each connection's
+// peer is told that the server is going away, so that it can stop
+// making new calls (see TransportGoingAway). Then each connection is closed as soon as it has
+// no calls in progress. Closing a connection sends an Abort message and
+// the close code CloseGoingAway.
+//
+// If ctx expires before every connection has been closed, the remaining
+// connections are closed at once, without waiting for the peer to read
+// what has been sent, and the context's error is returned.
+//
+// Shutdown does not close the HTTP server a websocket listener is
+// mounted on: call http.Server.Shutdown alongside it.
+func (s *Server) Shutdown(ctx context.Context) error {
+	err := s.closeListener()
+	for _, c := range s.Conns() {
+		go c.goAway("server shutting down")
+	}
+
+	ticker := time.NewTicker(shutdownPollInterval)
+	defer ticker.Stop()
+	for {
+		if s.closeIdleConns() {
+			return err
+		}
+
+		select {
+		case <-ctx.Done():
+			closeConns(s.Conns(), false)
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+func (s *Server) closeListener() error {
+	s.mu.Lock()
+	s.shuttingDown = true
+	s.mu.Unlock()
+
+	if c, ok := s.listener.(io.Closer); ok {
+		return c.Close()
+	}
+	return nil
+}
+
+// closeIdleConns closes the connections which have no calls in
+// progress and reports whether all connections have gone.
+func (s *Server) closeIdleConns() bool {
+	conns := s.Conns()
+	var idle []*Conn
+	for _, c := range conns {
+		if c.Idle() {
+			idle = append(idle, c)
+		}
+	}
+	closeConns(idle, true)
+	return len(conns) == 0
+}
+
+// closeConns closes conns concurrently, waiting until they have all
+// closed. If flush is set, each peer is sent the close code
+// CloseGoingAway once what has been sent to it has been written.
+func closeConns(conns []*Conn, flush bool) {
+	var wg sync.WaitGroup
+	for _, c := range conns {
+		wg.Add(1)
+		go func(c *Conn) {
+			defer wg.Done()
+			if flush {
+				c.CloseWithReason(CloseGoingAway, "server shutting down")
+			} else {
+				c.abandon()
+			}
+		}(c)
+	}
+	wg.Wait()
+}
@@ -0,0 +1,155 @@
+package capngopher
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"zombiezen.com/go/capnproto2"
+	"zombiezen.com/go/capnproto2/rpc"
+
+	"github.com/kothar/capngopher/example/service"
+)
+
+// blockingPinger answers pings once release is closed.
+type blockingPinger struct {
+	started chan struct{}
+	release chan struct{}
+}
+
+func (s blockingPinger) Ping(p service.Pinger_ping) error {
+	s.started <- struct{}{}
+	<-s.release
+	return p.Results.SetMsg("pong")
+}
+
+// serveOnPipe serves impl on one end of a pipe, and returns a client
+// transport on the other end once the server is tracking the
+// connection.
+func serveOnPipe(impl service.Pinger_Server, options ...ServerOption) (*Server, *MessageTransport) {
+	return serveClientOnPipe(func() capnp.Client {
+		return service.Pinger_ServerToClient(impl).Client
+	}, options...)
+}
+
+// serveClientOnPipe is like serveOnPipe, but serves the clients returned
+// by bootstrap.
+func serveClientOnPipe(bootstrap func() capnp.Client, options ...ServerOption) (*Server, *MessageTransport) {
+	srv := NewServer(nil, func(info ConnInfo) capnp.Client {
+		return bootstrap()
+	}, options...)
+	a, b := newPipe()
+	go srv.ServeTransport(NewMessageTransport(a))
+	for len(srv.Conns()) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	return srv, NewMessageTransport(b)
+}
+
+func ping(ctx context.Context, p service.Pinger) error {
+	_, err := p.Ping(ctx, func(p service.Pinger_ping_Params) error {
+		return p.SetMsg("ping")
+	}).Struct()
+	return err
+}
+
+func TestShutdownGoingAway(t *testing.T) {
+	impl := blockingPinger{started: make(chan struct{}), release: make(chan struct{})}
+	srv, tr := serveOnPipe(impl)
+	c := rpc.NewConn(tr)
+	defer c.Close()
+
+	ctx := context.Background()
+	p := service.Pinger{Client: c.Bootstrap(ctx)}
+	errs := make(chan error, 1)
+	go func() {
+		errs <- ping(ctx, p)
+	}()
+	<-impl.started
+
+	shutdown := make(chan error, 1)
+	go func() {
+		shutdown <- srv.Shutdown(ctx)
+	}()
+	select {
+	case <-tr.GoingAway():
+	case <-time.After(time.Second):
+		t.Fatal("no going away notice during shutdown")
+	}
+
+	close(impl.release)
+	if err := <-errs; err != nil {
+		t.Errorf("call in progress: %v", err)
+	}
+	if err := <-shutdown; err != nil {
+		t.Errorf("Shutdown: %v", err)
+	}
+}
+
+func TestShutdownDeadline(t *testing.T) {
+	impl := blockingPinger{started: make(chan struct{}), release: make(chan struct{})}
+	defer close(impl.release)
+	srv, tr := serveOnPipe(impl)
+	c := rpc.NewConn(tr)
+	defer c.Close()
+
+	ctx := context.Background()
+	p := service.Pinger{Client: c.Bootstrap(ctx)}
+	go ping(ctx, p)
+	<-impl.started
+
+	ctx, cancel := context.WithTimeout(ctx, 50*time.Millisecond)
+	defer cancel()
+	returnsWithin(t, time.Second, func() {
+		if err := srv.Shutdown(ctx); err != context.DeadlineExceeded {
+			t.Errorf("Shutdown: %v; want %v", err, context.DeadlineExceeded)
+		}
+	})
+}
+
+func TestConnWait(t *testing.T) {
+	tests := []struct {
+		name  string
+		close func(tr *MessageTransport)
+		check func(err error) bool
+	}{
+		{"normal", func(tr *MessageTransport) {
+			tr.Close()
+		}, func(err error) bool {
+			return err == nil
+		}},
+		{"close code", func(tr *MessageTransport) {
+			tr.CloseWithReason(4000, "bye")
+		}, func(err error) bool {
+			closeErr, ok := err.(*CloseError)
+			return ok && closeErr.Code == 4000 && closeErr.Reason == "bye"
+		}},
+		{"bad message", func(tr *MessageTransport) {
+			tr.conn.WriteMessage([]byte{1, 2, 3})
+		}, func(err error) bool {
+			_, ok := err.(*CloseError)
+			return err != nil && !ok
+		}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			srv, tr := serveOnPipe(&service.PingerServer{})
+			defer tr.Close()
+			conn := srv.Conns()[0]
+			test.close(tr)
+
+			errs := make(chan error, 1)
+			go func() {
+				errs <- conn.Wait()
+			}()
+			select {
+			case err := <-errs:
+				if !test.check(err) {
+					t.Errorf("Wait: %v", err)
+				}
+			case <-time.After(time.Second):
+				t.Fatal("Wait did not return")
+			}
+		})
+	}
+}
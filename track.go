@@ -0,0 +1,64 @@
+package capngopher
+
+import (
+	"context"
+	"sync"
+
+	"zombiezen.com/go/capnproto2/rpc"
+	rpccapnp "zombiezen.com/go/capnproto2/std/capnp/rpc"
+)
+
+// callTracker wraps a transport to keep track of the calls received
+// from the remote vat which have not been returned yet.
+type callTracker struct {
+	rpc.Transport
+
+	mu      sync.Mutex
+	pending map[uint32]struct{}
+}
+
+func newCallTracker(t rpc.Transport) *callTracker {
+	return &callTracker{
+		Transport: t,
+		pending:   make(map[uint32]struct{}),
+	}
+}
+
+func (t *callTracker) RecvMessage(ctx context.Context) (rpccapnp.Message, error) {
+	msg, err := t.Transport.RecvMessage(ctx)
+	if err != nil {
+		return msg, err
+	}
+
+	if msg.Which() == rpccapnp.Message_Which_call {
+		if call, err := msg.Call(); err == nil {
+			t.mu.Lock()
+			t.pending[call.QuestionId()] = struct{}{}
+			t.mu.Unlock()
+		}
+	}
+	return msg, nil
+}
+
+func (t *callTracker) SendMessage(ctx context.Context, msg rpccapnp.Message) error {
+	if msg.Which() == rpccapnp.Message_Which_return {
+		if ret, err := msg.Return(); err == nil {
+			t.mu.Lock()
+			delete(t.pending, ret.AnswerId())
+			t.mu.Unlock()
+		}
+	}
+	return t.Transport.SendMessage(ctx, msg)
+}
+
+// Unwrap returns the transport which t wraps.
+func (t *callTracker) Unwrap() rpc.Transport {
+	return t.Transport
+}
+
+// active returns the number of calls in progress.
+func (t *callTracker) active() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return len(t.pending)
+}
@@ -0,0 +1,428 @@
+package capngopher
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	rpccapnp "zombiezen.com/go/capnproto2/std/capnp/rpc"
+)
+
+// DefaultMaxMessageSize is the largest message a MessageTransport will
+// receive unless configured otherwise.
+const DefaultMaxMessageSize = 32 << 20
+
+// A MessageConn sends and receives whole messages, such as websocket
+// frames or WebRTC data channel messages.
+type MessageConn interface {
+	// ReadMessage blocks until the next message is received.
+	ReadMessage() ([]byte, error)
+
+	// WriteMessage sends p as a single message.
+	WriteMessage(p []byte) error
+
+	Close() error
+}
+
+// MessageTransport is an rpc.Transport which sends each Cap'n Proto
+// message as exactly one message on a MessageConn, instead of treating
+// the connection as a byte stream.
+type MessageTransport struct {
+	conn           MessageConn
+	maxMessageSize int
+	maxSegments    int
+	traverseLimit  uint64
+	encoding       Encoding
+	keepalive      time.Duration
+	idleTimeout    time.Duration
+	drainTimeout   time.Duration
+	noControl      bool
+
+	wlock chan struct{} // held while writing to conn
+	emu   sync.Mutex    // guards enc when there is a send queue
+	enc   codec
+	dec   codec
+	queue *sendQueue
+
+	// Messages answered locally, instead of by the peer.
+	lmu        sync.Mutex
+	local      []rpccapnp.Message
+	localReady chan struct{}
+	unsent     map[uint32]bool // questions whose Finish is not sent
+
+	lastRecv int64 // unix nanoseconds, accessed atomically
+	rtt      int64 // accessed atomically
+
+	pinging  int32 // set while a ping is being sent, accessed atomically
+	pingMu   sync.Mutex
+	pingSeq  uint64
+	pingSent time.Time
+
+	pongMu      sync.Mutex
+	pongPending bool   // set while a pong waits to be sent
+	pongArg     string // the argument of the latest ping
+
+	goingAway  chan struct{} // closed when the peer says it is going away
+	goAwayOnce sync.Once
+
+	recv      chan received
+	closed    chan struct{}
+	closeOnce sync.Once
+	dead      chan struct{} // closed when the connection fails or is closed
+	deadOnce  sync.Once
+
+	mu          sync.Mutex
+	err         error // why the transport closed
+	closeCode   int
+	closeReason string
+}
+
+type received struct {
+	data []byte
+	err  error
+}
+
+type TransportOption func(t *MessageTransport)
+
+// WithMaxMessageSize sets the size in bytes of the largest message the
+// transport will receive.
+func WithMaxMessageSize(n int) TransportOption {
+	return func(t *MessageTransport) {
+		t.maxMessageSize = n
+	}
+}
+
+// WithMaxSegments sets the largest number of segments a received
+// message may have.
+func WithMaxSegments(n int) TransportOption {
+	return func(t *MessageTransport) {
+		t.maxSegments = n
+	}
+}
+
+// WithTraversalLimit sets the number of bytes which may be read from
+// each received message, counting data read more than once. When it is
+// set, each message is read in full as it is received, and the
+// transport is closed if it exceeds the limit. The default is Cap'n
+// Proto's own limit of 64 MiB, checked only as the message is used.
+func WithTraversalLimit(bytes uint64) TransportOption {
+	return func(t *MessageTransport) {
+		t.traverseLimit = bytes
+	}
+}
+
+// WithEncoding sets how messages are serialized. Both ends of the
+// connection must use the same encoding.
+func WithEncoding(e Encoding) TransportOption {
+	return func(t *MessageTransport) {
+		t.encoding = e
+	}
+}
+
+// NewMessageTransport creates a transport which sends and receives
+// messages on conn.
+func NewMessageTransport(conn MessageConn, options ...TransportOption) *MessageTransport {
+	t := &MessageTransport{
+		conn:           conn,
+		maxMessageSize: DefaultMaxMessageSize,
+		drainTimeout:   defaultDrainTimeout,
+		wlock:          make(chan struct{}, 1),
+		goingAway:      make(chan struct{}),
+		recv:           make(chan received),
+		closed:         make(chan struct{}),
+		dead:           make(chan struct{}),
+		localReady:     make(chan struct{}, 1),
+		unsent:         make(map[uint32]bool),
+	}
+	for _, option := range options {
+		option(t)
+	}
+	t.enc = codec{encoding: t.encoding}
+	t.dec = codec{
+		encoding:      t.encoding,
+		maxSize:       t.maxMessageSize,
+		maxSegments:   t.maxSegments,
+		traverseLimit: t.traverseLimit,
+	}
+	t.lastRecv = time.Now().UnixNano()
+
+	if l, ok := conn.(interface {
+		SetMaxMessageSize(n int)
+	}); ok {
+		// Let the connection refuse oversized messages before reading
+		// them into memory.
+		l.SetMaxMessageSize(t.maxMessageSize)
+	}
+
+	go t.readLoop()
+	if t.queue != nil {
+		go t.writeLoop()
+	}
+	if t.keepalive > 0 {
+		go t.keepaliveLoop()
+	}
+	return t
+}
+
+func (t *MessageTransport) readLoop() {
+	for {
+		data, err := t.read()
+		if err != nil {
+			t.fail(err)
+			t.die()
+		}
+		select {
+		case t.recv <- received{data, err}:
+		case <-t.closed:
+			return
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+// read returns the next Cap'n Proto message from the connection,
+// handling any control messages which arrive before it.
+func (t *MessageTransport) read() ([]byte, error) {
+	cc, ok := t.controlConn()
+	if !ok {
+		data, err := t.conn.ReadMessage()
+		if err == nil {
+			atomic.StoreInt64(&t.lastRecv, time.Now().UnixNano())
+		}
+		return data, err
+	}
+
+	for {
+		data, control, err := cc.ReadFrame()
+		if err != nil {
+			return nil, err
+		}
+		atomic.StoreInt64(&t.lastRecv, time.Now().UnixNano())
+		if !control {
+			return data, nil
+		}
+		t.handleControl(data)
+	}
+}
+
+func (t *MessageTransport) SendMessage(ctx context.Context, msg rpccapnp.Message) error {
+	if t.unsentFinish(msg) {
+		return nil
+	}
+	if id, ok := t.pipelinedOnUnsent(msg); ok {
+		// The peer does not know the question the call is pipelined on.
+		return t.answerLocally(id, rpccapnp.Exception_Type_overloaded, ErrSendQueueFull.Error())
+	}
+	if t.queue != nil {
+		t.emu.Lock()
+		data, err := t.enc.encode(msg.Segment().Message())
+		t.emu.Unlock()
+		if err != nil {
+			return err
+		}
+		return t.enqueue(ctx, msg, data)
+	}
+
+	t.lockWrites(time.Time{})
+	defer t.unlockWrites()
+	data, err := t.enc.encode(msg.Segment().Message())
+	if err != nil {
+		return err
+	}
+	return t.conn.WriteMessage(data)
+}
+
+var errWriteTimeout = errors.New("capngopher: write timed out")
+
+// lockWrites takes the lock held while writing to the connection,
+// giving up if it cannot be taken before deadline. A zero deadline
+// waits for as long as it takes.
+func (t *MessageTransport) lockWrites(deadline time.Time) bool {
+	if deadline.IsZero() {
+		t.wlock <- struct{}{}
+		return true
+	}
+
+	timer := time.NewTimer(time.Until(deadline))
+	defer timer.Stop()
+	select {
+	case t.wlock <- struct{}{}:
+		return true
+	case <-timer.C:
+		return false
+	}
+}
+
+func (t *MessageTransport) unlockWrites() {
+	<-t.wlock
+}
+
+// setWriteDeadline makes writes to the connection fail after deadline,
+// if the connection supports deadlines.
+func (t *MessageTransport) setWriteDeadline(deadline time.Time) {
+	if d, ok := t.conn.(interface {
+		SetWriteDeadline(t time.Time) error
+	}); ok {
+		d.SetWriteDeadline(deadline)
+	}
+}
+
+func (t *MessageTransport) RecvMessage(ctx context.Context) (rpccapnp.Message, error) {
+	for {
+		if msg, ok := t.nextLocal(); ok {
+			return msg, nil
+		}
+
+		var r received
+		select {
+		case r = <-t.recv:
+		case <-t.localReady:
+			continue
+		case <-t.closed:
+			return rpccapnp.Message{}, t.Err()
+		case <-ctx.Done():
+			return rpccapnp.Message{}, ctx.Err()
+		}
+		if _, ok := r.err.(*LimitError); ok {
+			return rpccapnp.Message{}, t.reject(r.err)
+		}
+		if r.err != nil {
+			return rpccapnp.Message{}, t.Err()
+		}
+
+		data, err := t.dec.decode(r.data)
+		if err != nil {
+			return rpccapnp.Message{}, t.reject(err)
+		}
+		return rpccapnp.ReadRootMessage(data)
+	}
+}
+
+// reject closes the transport after receiving a bad message, telling
+// the peer why. It returns err.
+func (t *MessageTransport) reject(err error) error {
+	t.fail(err)
+	code := CloseInvalidPayload
+	if _, ok := err.(*LimitError); ok {
+		code = CloseMessageTooBig
+	}
+	t.CloseWithReason(code, err.Error())
+	return err
+}
+
+// Err returns the error which closed the transport, or nil while it is
+// open. If the peer closed the connection with a close code, the error
+// is a *CloseError.
+func (t *MessageTransport) Err() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.err
+}
+
+// fail records err as the reason the transport closed, unless a reason
+// has already been recorded.
+func (t *MessageTransport) fail(err error) {
+	t.mu.Lock()
+	if t.err == nil {
+		t.err = err
+	}
+	t.mu.Unlock()
+}
+
+// Done returns a channel which is closed as soon as the connection fails
+// or the transport is closed, even if nothing is receiving from the
+// transport.
+func (t *MessageTransport) Done() <-chan struct{} {
+	return t.dead
+}
+
+func (t *MessageTransport) die() {
+	t.deadOnce.Do(func() {
+		close(t.dead)
+	})
+}
+
+// Close waits for writes in progress and the send queue to be written,
+// for up to five seconds, then closes the underlying connection.
+// Closing the transport more than once has no further effect.
+func (t *MessageTransport) Close() error {
+	return t.closeWith(ErrTransportClosed, true)
+}
+
+// CloseWithReason is like Close, but tells the peer why the transport
+// is being closed. The peer's transport reports code and reason as a
+// *CloseError.
+func (t *MessageTransport) CloseWithReason(code int, reason string) error {
+	t.setCloseReason(code, reason)
+	return t.Close()
+}
+
+// setCloseReason sends code and reason to the peer ahead of closing the
+// transport, so that they arrive before any final RPC messages.
+//
+// Closing must not wait on a peer which has stopped reading, so from
+// here the transport is given five seconds to close. If the reason
+// cannot be sent in time, or the transport has not closed by then, the
+// connection is closed without flushing.
+func (t *MessageTransport) setCloseReason(code int, reason string) {
+	t.mu.Lock()
+	t.closeCode, t.closeReason = code, reason
+	t.mu.Unlock()
+
+	deadline := time.Now().Add(t.drainTimeout)
+	time.AfterFunc(t.drainTimeout, t.abandon)
+	t.setWriteDeadline(deadline)
+	if t.sendControlBy(deadline, controlClose, strconv.Itoa(code)+" "+reason) != nil {
+		t.abandon()
+	}
+}
+
+// abandon closes the transport without flushing, unblocking any writes
+// in progress, even those of a flushing close.
+func (t *MessageTransport) abandon() {
+	t.fail(ErrTransportClosed)
+	t.conn.Close()
+	t.closeWith(ErrTransportClosed, false)
+}
+
+// closeWith closes the transport, recording reason as its error. If
+// flush is set, writes in progress are allowed five seconds to finish
+// and the peer is sent a close code if the connection supports one.
+func (t *MessageTransport) closeWith(reason error, flush bool) error {
+	var err error
+	t.closeOnce.Do(func() {
+		t.fail(reason)
+		deadline := time.Now().Add(t.drainTimeout)
+		if flush && t.queue != nil {
+			t.queue.drain(t.drainTimeout)
+		}
+		close(t.closed)
+		t.die()
+		if !flush || !t.lockWrites(deadline) {
+			err = t.conn.Close()
+			return
+		}
+
+		defer t.unlockWrites()
+		rc, ok := t.conn.(ReasonCloser)
+		if !ok {
+			err = t.conn.Close()
+			return
+		}
+
+		t.mu.Lock()
+		code, text := t.closeCode, t.closeReason
+		t.mu.Unlock()
+		if code == 0 {
+			code = CloseNormal
+		}
+		t.setWriteDeadline(deadline)
+		err = rc.CloseWithReason(code, text)
+	})
+	return err
+}
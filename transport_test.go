@@ -0,0 +1,173 @@
+package capngopher
+
+import (
+	"context"
+	"io"
+	"sync"
+	"testing"
+	"time"
+
+	"zombiezen.com/go/capnproto2/rpc"
+	rpccapnp "zombiezen.com/go/capnproto2/std/capnp/rpc"
+
+	"github.com/kothar/capngopher/example/service"
+)
+
+// stalledConn is a connection to a peer which has stopped reading:
+// writes block until the connection is closed.
+type stalledConn struct {
+	closed chan struct{}
+	once   sync.Once
+}
+
+func newStalledConn() *stalledConn {
+	return &stalledConn{closed: make(chan struct{})}
+}
+
+func (c *stalledConn) ReadMessage() ([]byte, error) {
+	<-c.closed
+	return nil, io.EOF
+}
+
+func (c *stalledConn) ReadFrame() ([]byte, bool, error) {
+	p, err := c.ReadMessage()
+	return p, false, err
+}
+
+func (c *stalledConn) WriteMessage(p []byte) error {
+	<-c.closed
+	return io.ErrClosedPipe
+}
+
+func (c *stalledConn) WriteControl(p []byte) error {
+	return c.WriteMessage(p)
+}
+
+func (c *stalledConn) CloseWithReason(code int, reason string) error {
+	err := c.WriteMessage(nil)
+	c.Close()
+	return err
+}
+
+func (c *stalledConn) Close() error {
+	c.once.Do(func() { close(c.closed) })
+	return nil
+}
+
+// shortDrain gives the transport less time to flush when closing.
+func shortDrain(t *MessageTransport) {
+	t.drainTimeout = 50 * time.Millisecond
+}
+
+// returnsWithin fails the test if f does not return within d.
+func returnsWithin(t *testing.T, d time.Duration, f func()) {
+	t.Helper()
+	done := make(chan struct{})
+	go func() {
+		f()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(d):
+		t.Fatal("did not return in time")
+	}
+}
+
+func TestCloseWithReasonStalledWrite(t *testing.T) {
+	for _, options := range [][]TransportOption{
+		{shortDrain},
+		{shortDrain, WithSendQueue(1<<10, QueueBlock)},
+	} {
+		msg, err := newAbort(rpccapnp.Exception_Type_failed, "stuck")
+		if err != nil {
+			t.Fatal(err)
+		}
+		tr := NewMessageTransport(newStalledConn(), options...)
+		go tr.SendMessage(context.Background(), msg)
+		time.Sleep(10 * time.Millisecond)
+
+		returnsWithin(t, time.Second, func() {
+			tr.CloseWithReason(CloseGoingAway, "bye")
+		})
+		if tr.Err() != ErrTransportClosed {
+			t.Errorf("Err() = %v; want %v", tr.Err(), ErrTransportClosed)
+		}
+	}
+}
+
+func TestCloseConnStalledWrite(t *testing.T) {
+	tr := NewMessageTransport(newStalledConn(), shortDrain)
+	c := rpc.NewConn(tr)
+	p := service.Pinger{Client: c.Bootstrap(context.Background())}
+	p.Ping(context.Background(), func(p service.Pinger_ping_Params) error {
+		return p.SetMsg("x")
+	})
+	time.Sleep(10 * time.Millisecond)
+
+	// As Conn.CloseWithReason does.
+	returnsWithin(t, time.Second, func() {
+		tr.setCloseReason(CloseGoingAway, "bye")
+		c.Close()
+	})
+}
+
+// pipeConn is one end of an in-memory connection. Writes wait for the
+// other end to read them.
+type pipeConn struct {
+	in, out chan pipeFrame
+	closed  chan struct{}
+	once    *sync.Once
+}
+
+type pipeFrame struct {
+	data    []byte
+	control bool
+}
+
+func newPipe() (*pipeConn, *pipeConn) {
+	a, b := make(chan pipeFrame), make(chan pipeFrame)
+	closed, once := make(chan struct{}), new(sync.Once)
+	return &pipeConn{in: a, out: b, closed: closed, once: once},
+		&pipeConn{in: b, out: a, closed: closed, once: once}
+}
+
+func (c *pipeConn) ReadMessage() ([]byte, error) {
+	for {
+		p, control, err := c.ReadFrame()
+		if err != nil || !control {
+			return p, err
+		}
+	}
+}
+
+func (c *pipeConn) ReadFrame() ([]byte, bool, error) {
+	select {
+	case f := <-c.in:
+		return f.data, f.control, nil
+	case <-c.closed:
+		return nil, false, io.EOF
+	}
+}
+
+func (c *pipeConn) write(f pipeFrame) error {
+	select {
+	case c.out <- f:
+		return nil
+	case <-c.closed:
+		return io.ErrClosedPipe
+	}
+}
+
+func (c *pipeConn) WriteMessage(p []byte) error {
+	return c.write(pipeFrame{data: p})
+}
+
+func (c *pipeConn) WriteControl(p []byte) error {
+	return c.write(pipeFrame{data: p, control: true})
+}
+
+func (c *pipeConn) Close() error {
+	c.once.Do(func() { close(c.closed) })
+	return nil
+}
@@ -1,12 +1,23 @@
+// Package webrtc serves Cap'n Proto RPC over WebRTC data channels
+// between browsers, using PeerJS to connect peers.
+//
+// Each Cap'n Proto message is sent as a single data channel message.
+// Earlier versions of this package framed messages as a byte stream with
+// rpc.StreamTransport instead. The two formats are not compatible, so
+// peers using either version can only talk to peers using the same one.
 package webrtc
 
 import (
+	"context"
 	"errors"
 	"log"
+	"sync"
 	"time"
 
 	"github.com/gopherjs/gopherjs/js"
 	"zombiezen.com/go/capnproto2/rpc"
+
+	"github.com/kothar/capngopher"
 )
 
 type PeerError struct {
@@ -93,29 +104,71 @@ func (p *Peer) ID() (string, error) {
 type PeerListener struct {
 	peer      *Peer
 	onConnect chan *PeerConnection
+	options   []capngopher.TransportOption
+
+	done      chan struct{}
+	closeOnce sync.Once
 }
 
-func (p *Peer) Listen() (*PeerListener, error) {
+// Listen accepts connections from remote peers. Each connection's
+// transport is created with options, which can limit the size of the
+// messages it will receive. Remote peers must send one message per data
+// channel message; see the package documentation.
+func (p *Peer) Listen(options ...capngopher.TransportOption) (*PeerListener, error) {
 
 	l := &PeerListener{
 		peer:      p,
 		onConnect: make(chan *PeerConnection),
+		options:   options,
+		done:      make(chan struct{}),
 	}
 
 	p.o.Call("on", "connection", func(conn *js.Object) {
-		c := newPeerConnection(conn)
-		log.Println("Received connection from remote peer ", c.Peer)
-		l.onConnect <- c
+		go func() {
+			c := newPeerConnection(conn)
+			log.Println("Received connection from remote peer ", c.Peer)
+
+			select {
+			case l.onConnect <- c:
+			case <-l.done:
+				log.Println("Listener closed, rejecting connection from remote peer ", c.Peer)
+				c.Close()
+			}
+		}()
 	})
 
 	return l, nil
 }
 
+// Accept waits for the next connection from a remote peer. It returns
+// capngopher.ErrListenerClosed once the listener has been closed.
 func (l *PeerListener) Accept() (rpc.Transport, error) {
-	c := <-l.onConnect
-	log.Println("Accepted connection from remote peer ", c.Peer)
-	t := rpc.StreamTransport(c)
-	return t, nil
+	return l.AcceptContext(context.Background())
+}
+
+// AcceptContext is like Accept, but gives up and returns the context's
+// error if ctx is done before a connection arrives.
+func (l *PeerListener) AcceptContext(ctx context.Context) (rpc.Transport, error) {
+	select {
+	case c := <-l.onConnect:
+		log.Println("Accepted connection from remote peer ", c.Peer)
+		t := capngopher.NewMessageTransport(c, l.options...)
+		return capngopher.WithConnInfo(t, capngopher.ConnInfo{PeerID: c.Peer}), nil
+	case <-l.done:
+		return nil, capngopher.ErrListenerClosed
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// Close stops the listener. Blocked Accept operations return
+// capngopher.ErrListenerClosed and further connections from remote
+// peers are closed as they arrive.
+func (l *PeerListener) Close() error {
+	l.closeOnce.Do(func() {
+		close(l.done)
+	})
+	return nil
 }
 
 type PeerConnection struct {
@@ -131,24 +184,44 @@ type PeerConnection struct {
 
 	buffer []byte
 	onData chan []byte
+
+	maxSize  int
+	onTooBig chan error
 }
 
-func (p *Peer) Connect(remoteID string) (rpc.Transport, error) {
+// Connect opens a connection to a remote peer. Each Cap'n Proto message
+// is sent as a single data channel message, which peers using earlier
+// versions of this package do not understand.
+func (p *Peer) Connect(remoteID string, options ...capngopher.TransportOption) (rpc.Transport, error) {
 	conn := p.o.Call("connect", remoteID)
 	log.Println("Connecting to remote peer ", remoteID)
 
 	c := newPeerConnection(conn)
-	t := rpc.StreamTransport(c)
+	t := capngopher.NewMessageTransport(c, options...)
 
 	return t, nil
 }
 
+// ConnectClient opens a connection to a remote peer like Connect, and
+// starts an RPC connection on it, asking the peer for its bootstrap
+// capability. transportOptions configure the transport, and options the
+// RPC connection. Closing the returned connection closes the data
+// channel too.
+func (p *Peer) ConnectClient(remoteID string, transportOptions []capngopher.TransportOption, options ...rpc.ConnOption) (*capngopher.ClientConn, error) {
+	t, err := p.Connect(remoteID, transportOptions...)
+	if err != nil {
+		return nil, err
+	}
+	return capngopher.NewClientConn(t, options...), nil
+}
+
 func newPeerConnection(conn *js.Object) *PeerConnection {
 	c := &PeerConnection{
 		o: conn,
 	}
 
 	c.onData = make(chan []byte)
+	c.onTooBig = make(chan error)
 	c.onErr = make(chan error)
 	c.onReady = make(chan struct{})
 
@@ -183,18 +256,27 @@ func newPeerConnection(conn *js.Object) *PeerConnection {
 			log.Println("Connection to " + c.Peer + " closed")
 			c.status = "closed"
 
-			c.err = errors.New("Closed")
-			onErr := c.onErr
-			c.onErr = nil
-			log.Println("Marked connection as closed")
-			onErr <- c.err
-			close(onErr)
+			if c.err == nil {
+				c.err = errors.New("Closed")
+			}
+			if c.onErr != nil {
+				onErr := c.onErr
+				c.onErr = nil
+				log.Println("Marked connection as closed")
+				onErr <- c.err
+				close(onErr)
+			}
 		}()
 	})
 	conn.Call("on", "data", func(data *js.Object) {
 		go func() {
-			bytes := js.Global.Get("Uint8Array").New(data).Interface().([]byte)
-			c.onData <- bytes
+			// Check the size before the data is copied into Go memory.
+			array := js.Global.Get("Uint8Array").New(data)
+			if n := array.Length(); c.maxSize > 0 && n > c.maxSize {
+				c.onTooBig <- &capngopher.LimitError{Limit: "size", Value: n, Max: c.maxSize}
+				return
+			}
+			c.onData <- array.Interface().([]byte)
 		}()
 	})
 	conn.Call("on", "error", func(err *PeerError) {
@@ -225,6 +307,8 @@ func (c *PeerConnection) Read(p []byte) (n int, err error) {
 		select {
 		case err = <-c.onErr:
 			return 0, err
+		case err = <-c.onTooBig:
+			return 0, err
 		case c.buffer = <-c.onData:
 			remaining = len(c.buffer)
 		}
@@ -243,6 +327,36 @@ func (c *PeerConnection) Read(p []byte) (n int, err error) {
 	return n, c.err
 }
 
+// ReadMessage returns the data of the next data channel message. It
+// implements capngopher.MessageConn.
+func (c *PeerConnection) ReadMessage() ([]byte, error) {
+	if c.err != nil {
+		return nil, c.err
+	}
+
+	select {
+	case err := <-c.onErr:
+		return nil, err
+	case err := <-c.onTooBig:
+		return nil, err
+	case p := <-c.onData:
+		return p, nil
+	}
+}
+
+// SetMaxMessageSize sets the size in bytes of the largest data channel
+// message which will be read. Larger messages are refused before they
+// are copied out of the browser.
+func (c *PeerConnection) SetMaxMessageSize(n int) {
+	c.maxSize = n
+}
+
+// WriteMessage sends p as a single data channel message.
+func (c *PeerConnection) WriteMessage(p []byte) error {
+	_, err := c.Write(p)
+	return err
+}
+
 func (c *PeerConnection) Write(p []byte) (n int, err error) {
 	if c.err != nil {
 		return 0, c.err
@@ -0,0 +1,20 @@
+package client
+
+import (
+	"context"
+
+	"github.com/kothar/capngopher"
+)
+
+// DialClient connects to a websocket server like DialContext, and starts
+// an RPC connection on the transport, asking the server for its
+// bootstrap capability. ctx only limits how long connecting may take.
+// Closing the returned connection closes the websocket too.
+func DialClient(ctx context.Context, addr string, options ...DialOption) (*capngopher.ClientConn, error) {
+	config := newDialConfig(options)
+	t, err := config.dialTransport(ctx, addr)
+	if err != nil {
+		return nil, err
+	}
+	return capngopher.NewClientConn(t, config.rpc...), nil
+}
@@ -1,15 +1,317 @@
+//go:build !js
+// +build !js
+
 package client
 
 import (
-	"github.com/goxjs/websocket"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"golang.org/x/net/websocket"
 	"zombiezen.com/go/capnproto2/rpc"
+
+	"github.com/kothar/capngopher"
+	"github.com/kothar/capngopher/ws"
 )
 
-func Dial(addr string) (rpc.Transport, error) {
-	c, err := websocket.Dial(addr, "") // Blocks until connection is established
+// dialConfig holds the options given to Dial.
+type dialConfig struct {
+	protocols []string
+	query     url.Values
+	transport []capngopher.TransportOption
+	rpc       []rpc.ConnOption
+
+	header http.Header
+	origin string
+
+	tlsConfig *tls.Config
+	proxy     func(*http.Request) (*url.URL, error)
+	dialFunc  func(ctx context.Context, network, addr string) (net.Conn, error)
+}
+
+// WithHeader adds a header to the websocket upgrade request.
+func WithHeader(key, value string) DialOption {
+	return func(config *dialConfig) {
+		if config.header == nil {
+			config.header = make(http.Header)
+		}
+		config.header.Add(key, value)
+	}
+}
+
+// WithBearerToken passes a bearer token in the Authorization header of
+// the websocket upgrade request, as accepted by server.BearerToken.
+func WithBearerToken(token string) DialOption {
+	return WithHeader("Authorization", "Bearer "+token)
+}
+
+// WithOrigin sets the Origin header of the websocket upgrade request.
+// By default it is derived from the address, as a browser would send
+// for a page served from the same host.
+func WithOrigin(origin string) DialOption {
+	return func(config *dialConfig) {
+		config.origin = origin
+	}
+}
+
+// WithTLSConfig sets the TLS configuration used to connect to wss
+// addresses, for example to trust a private CA or present a client
+// certificate. The server name is taken from the address if the
+// configuration does not set one. The configuration is also used to
+// connect to https proxies, with the proxy's name.
+func WithTLSConfig(tlsConfig *tls.Config) DialOption {
+	return func(config *dialConfig) {
+		config.tlsConfig = tlsConfig
+	}
+}
+
+// WithProxy chooses the HTTP proxy to tunnel the connection through
+// with a CONNECT request, given a request for the address with an http
+// or https scheme. By default the proxy is chosen by
+// http.ProxyFromEnvironment, which honours HTTPS_PROXY for wss
+// addresses, HTTP_PROXY for ws addresses and NO_PROXY. A nil proxy
+// function connects directly.
+func WithProxy(proxy func(*http.Request) (*url.URL, error)) DialOption {
+	if proxy == nil {
+		proxy = func(*http.Request) (*url.URL, error) {
+			return nil, nil
+		}
+	}
+	return func(config *dialConfig) {
+		config.proxy = proxy
+	}
+}
+
+// WithDialFunc sets the function used to open the network connection
+// to the server, or to the proxy if there is one, such as the
+// DialContext method of a net.Dialer. Tests can use it to connect
+// through an in-memory net.Pipe.
+func WithDialFunc(dial func(ctx context.Context, network, addr string) (net.Conn, error)) DialOption {
+	return func(config *dialConfig) {
+		config.dialFunc = dial
+	}
+}
+
+// Dial connects to a websocket server, offering each of ws.Protocols
+// unless WithProtocols is given. The negotiated subprotocol selects the
+// encoding of the transport; servers which accept none are spoken to
+// with plain encoding.
+func Dial(addr string, options ...DialOption) (rpc.Transport, error) {
+	return DialContext(context.Background(), addr, options...)
+}
+
+// DialContext is like Dial, but gives up connecting when ctx is done.
+// Errors are returned as a *DialError, which has the HTTP status of the
+// response if the server rejected the handshake.
+func DialContext(ctx context.Context, addr string, options ...DialOption) (rpc.Transport, error) {
+	return newDialConfig(options).dialTransport(ctx, addr)
+}
+
+func (config *dialConfig) dialTransport(ctx context.Context, addr string) (rpc.Transport, error) {
+	location, err := config.location(addr)
+	if err != nil {
+		return nil, &DialError{Addr: addr, Err: err}
+	}
+	origin := config.origin
+	if origin == "" {
+		if origin, err = originFor(addr); err != nil {
+			return nil, &DialError{Addr: addr, Err: err}
+		}
+	}
+
+	wsConfig, err := websocket.NewConfig(location, origin)
+	if err != nil {
+		return nil, &DialError{Addr: addr, Err: err}
+	}
+	wsConfig.Protocol = append([]string(nil), config.protocols...)
+	wsConfig.Header = config.header
+	wsConfig.TlsConfig = config.tlsConfig
+
+	c, err := config.dial(ctx, addr, wsConfig)
 	if err != nil {
 		return nil, err
 	}
 
-	return rpc.StreamTransport(c), nil
+	var protocol string
+	if protocols := c.Config().Protocol; len(protocols) == 1 {
+		protocol = protocols[0]
+	}
+	encoding, ok := ws.Encoding(protocol)
+	if !ok {
+		c.Close()
+		return nil, &DialError{Addr: addr, Err: fmt.Errorf("capngopher: server chose unsupported subprotocol %q", protocol)}
+	}
+
+	transport := []capngopher.TransportOption{capngopher.WithEncoding(encoding)}
+	if !ws.ControlMessages(protocol) {
+		transport = append(transport, capngopher.WithoutControlMessages())
+	}
+	transport = append(transport, config.transport...)
+	return capngopher.NewMessageTransport(ws.NewConn(c), transport...), nil
+}
+
+// dial opens a websocket connection to addr described by wsConfig,
+// giving up when ctx is done. Errors name addr rather than
+// wsConfig.Location, which may carry credentials in its query string.
+func (config *dialConfig) dial(ctx context.Context, addr string, wsConfig *websocket.Config) (*websocket.Conn, error) {
+	fail := func(status int, err error) (*websocket.Conn, error) {
+		if ctx.Err() != nil {
+			err = ctx.Err()
+		}
+		return nil, &DialError{Addr: addr, Status: status, Err: err}
+	}
+
+	target := hostPort(wsConfig.Location)
+	proxy, err := config.proxyFor(wsConfig.Location)
+	if err != nil {
+		return fail(0, err)
+	}
+	dialAddr := target
+	if proxy != nil {
+		dialAddr = hostPort(proxy)
+	}
+
+	dialFunc := config.dialFunc
+	if dialFunc == nil {
+		dialFunc = new(net.Dialer).DialContext
+	}
+	conn, err := dialFunc(ctx, "tcp", dialAddr)
+	if err != nil {
+		return fail(0, err)
+	}
+
+	stop := interruptOnDone(ctx, conn)
+	var c *websocket.Conn
+	var status int
+	if proxy != nil {
+		conn, err = config.connectProxy(conn, proxy, target)
+	}
+	if err == nil {
+		c, status, err = handshake(wsConfig, conn)
+	}
+	interrupted := stop()
+	if err != nil {
+		conn.Close()
+		return fail(status, err)
+	}
+	if interrupted {
+		c.Close()
+		return fail(0, ctx.Err())
+	}
+	conn.SetDeadline(time.Time{})
+	return c, nil
+}
+
+// handshake establishes a websocket connection over conn, returning the
+// HTTP status of the response if the server rejected it.
+func handshake(config *websocket.Config, conn net.Conn) (*websocket.Conn, int, error) {
+	if config.Location.Scheme == "wss" {
+		tlsConfig := config.TlsConfig.Clone()
+		if tlsConfig == nil {
+			tlsConfig = new(tls.Config)
+		}
+		if tlsConfig.ServerName == "" {
+			tlsConfig.ServerName = config.Location.Hostname()
+		}
+		tc := tls.Client(conn, tlsConfig)
+		if err := tc.Handshake(); err != nil {
+			return nil, 0, err
+		}
+		conn = tc
+	}
+
+	hc := &handshakeConn{Conn: conn}
+	c, err := websocket.NewClient(config, hc)
+	if err == websocket.ErrBadStatus {
+		return nil, hc.status(), ErrHandshakeRejected
+	}
+	return c, 0, err
+}
+
+// interruptOnDone interrupts reads and writes on conn when ctx is done.
+// The function it returns stops watching ctx, and reports whether conn
+// was interrupted.
+func interruptOnDone(ctx context.Context, conn net.Conn) func() bool {
+	stop := make(chan struct{})
+	interrupted := make(chan bool, 1)
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.SetDeadline(time.Unix(1, 0))
+			interrupted <- true
+		case <-stop:
+			interrupted <- false
+		}
+	}()
+	return func() bool {
+		close(stop)
+		return <-interrupted
+	}
+}
+
+// hostPort returns the address to connect to for a websocket or proxy
+// URL.
+func hostPort(u *url.URL) string {
+	if u.Port() != "" {
+		return u.Host
+	}
+	if u.Scheme == "wss" || u.Scheme == "https" {
+		return net.JoinHostPort(u.Hostname(), "443")
+	}
+	return net.JoinHostPort(u.Hostname(), "80")
+}
+
+// statusLineSize is enough of the handshake response to hold its
+// status line.
+const statusLineSize = 32
+
+// handshakeConn keeps the start of what is read from a connection, so
+// that the status of a rejected handshake can be reported.
+type handshakeConn struct {
+	net.Conn
+	head []byte
+}
+
+func (c *handshakeConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	if len(c.head) < statusLineSize {
+		c.head = append(c.head, p[:n]...)
+	}
+	return n, err
+}
+
+// status returns the status code of the response read, or zero if it
+// cannot be parsed.
+func (c *handshakeConn) status() int {
+	fields := bytes.Fields(c.head)
+	if len(fields) < 2 || !bytes.HasPrefix(fields[0], []byte("HTTP/")) {
+		return 0
+	}
+	status, err := strconv.Atoi(string(fields[1]))
+	if err != nil {
+		return 0
+	}
+	return status
+}
+
+// originFor derives an origin for a websocket address, as a browser
+// would send for a page served from the same host.
+func originFor(addr string) (string, error) {
+	u, err := url.Parse(addr)
+	if err != nil {
+		return "", err
+	}
+
+	scheme := "http"
+	if u.Scheme == "wss" {
+		scheme = "https"
+	}
+	return scheme + "://" + u.Host, nil
 }
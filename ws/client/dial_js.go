@@ -0,0 +1,230 @@
+//go:build js
+// +build js
+
+package client
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/url"
+	"sync"
+
+	"github.com/gopherjs/gopherjs/js"
+	"zombiezen.com/go/capnproto2/rpc"
+
+	"github.com/kothar/capngopher"
+	"github.com/kothar/capngopher/ws"
+)
+
+// dialConfig holds the options given to Dial. Browsers do not allow
+// headers or the origin of websocket requests to be set.
+type dialConfig struct {
+	protocols []string
+	query     url.Values
+	transport []capngopher.TransportOption
+	rpc       []rpc.ConnOption
+}
+
+// Dial connects to a websocket server, offering each of ws.Protocols
+// unless WithProtocols is given. The negotiated subprotocol selects the
+// encoding of the transport; servers which accept none are spoken to
+// with plain encoding.
+func Dial(addr string, options ...DialOption) (rpc.Transport, error) {
+	return DialContext(context.Background(), addr, options...)
+}
+
+// DialContext is like Dial, but gives up connecting when ctx is done.
+// Errors are returned as a *DialError. Browsers do not reveal why a
+// connection failed, so a rejected handshake cannot be told apart from
+// a network error, and the DialError has no HTTP status.
+func DialContext(ctx context.Context, addr string, options ...DialOption) (rpc.Transport, error) {
+	return newDialConfig(options).dialTransport(ctx, addr)
+}
+
+func (config *dialConfig) dialTransport(ctx context.Context, addr string) (rpc.Transport, error) {
+	location, err := config.location(addr)
+	if err != nil {
+		return nil, &DialError{Addr: addr, Err: err}
+	}
+
+	c, err := dialSocket(ctx, location, config.protocols) // Blocks until connection is established
+	if err != nil {
+		return nil, &DialError{Addr: addr, Err: err}
+	}
+
+	protocol := c.o.Get("protocol").String()
+	encoding, ok := ws.Encoding(protocol)
+	if !ok {
+		c.Close()
+		return nil, &DialError{Addr: addr, Err: fmt.Errorf("capngopher: server chose unsupported subprotocol %q", protocol)}
+	}
+
+	transport := []capngopher.TransportOption{capngopher.WithEncoding(encoding)}
+	if !ws.ControlMessages(protocol) {
+		transport = append(transport, capngopher.WithoutControlMessages())
+	}
+	transport = append(transport, config.transport...)
+	return capngopher.NewMessageTransport(c, transport...), nil
+}
+
+// socket is a browser WebSocket which delivers whole messages. Control
+// messages are sent as text frames. It implements
+// capngopher.ControlConn and capngopher.ReasonCloser.
+type socket struct {
+	o *js.Object
+
+	mu       sync.Mutex
+	messages []message
+	err      error
+	notify   chan struct{}
+}
+
+type message struct {
+	data    []byte
+	control bool
+}
+
+func dialSocket(ctx context.Context, addr string, protocols []string) (*socket, error) {
+	o := js.Global.Get("WebSocket").New(addr, protocols)
+	o.Set("binaryType", "arraybuffer")
+
+	s := &socket{
+		o:      o,
+		notify: make(chan struct{}, 1),
+	}
+
+	onOpen := make(chan error, 1)
+	o.Call("addEventListener", "open", func(ev *js.Object) {
+		select {
+		case onOpen <- nil:
+		default:
+		}
+	})
+	o.Call("addEventListener", "error", func(ev *js.Object) {
+		select {
+		case onOpen <- ErrConnectionFailed:
+		default:
+		}
+	})
+	o.Call("addEventListener", "close", func(ev *js.Object) {
+		s.fail(&capngopher.CloseError{
+			Code:   ev.Get("code").Int(),
+			Reason: ev.Get("reason").String(),
+		})
+	})
+	o.Call("addEventListener", "message", func(ev *js.Object) {
+		s.push(messageData(ev.Get("data")))
+	})
+
+	select {
+	case err := <-onOpen:
+		if err != nil {
+			return nil, err
+		}
+		return s, nil
+	case <-ctx.Done():
+		s.fail(ctx.Err())
+		o.Call("close")
+		return nil, ctx.Err()
+	}
+}
+
+// messageData converts the data of a message event. Binary frames
+// arrive as an ArrayBuffer, and text frames, which carry control
+// messages, as a string.
+func messageData(data *js.Object) message {
+	if data.Get("constructor") == js.Global.Get("ArrayBuffer") {
+		return message{data: js.Global.Get("Uint8Array").New(data).Interface().([]byte)}
+	}
+	return message{data: []byte(data.String()), control: true}
+}
+
+// push queues a received message. It is called from event listeners,
+// so it must not block.
+func (s *socket) push(p message) {
+	s.mu.Lock()
+	s.messages = append(s.messages, p)
+	s.mu.Unlock()
+	s.wake()
+}
+
+func (s *socket) fail(err error) {
+	s.mu.Lock()
+	if s.err == nil {
+		s.err = err
+	}
+	s.mu.Unlock()
+	s.wake()
+}
+
+func (s *socket) wake() {
+	select {
+	case s.notify <- struct{}{}:
+	default:
+	}
+}
+
+func (s *socket) ReadMessage() ([]byte, error) {
+	for {
+		p, control, err := s.ReadFrame()
+		if err != nil || !control {
+			return p, err
+		}
+	}
+}
+
+func (s *socket) ReadFrame() ([]byte, bool, error) {
+	for {
+		s.mu.Lock()
+		if len(s.messages) > 0 {
+			m := s.messages[0]
+			s.messages = s.messages[1:]
+			s.mu.Unlock()
+			return m.data, m.control, nil
+		}
+		err := s.err
+		s.mu.Unlock()
+
+		if err != nil {
+			return nil, false, err
+		}
+		<-s.notify
+	}
+}
+
+func (s *socket) WriteMessage(p []byte) error {
+	return s.send(js.NewArrayBuffer(p))
+}
+
+func (s *socket) WriteControl(p []byte) error {
+	return s.send(string(p))
+}
+
+func (s *socket) send(data interface{}) error {
+	s.mu.Lock()
+	err := s.err
+	s.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	s.o.Call("send", data)
+	return nil
+}
+
+func (s *socket) Close() error {
+	return s.CloseWithReason(capngopher.CloseNormal, "")
+}
+
+// CloseWithReason closes the socket with a close code and reason.
+// Browsers only allow CloseNormal and codes from 3000 to 4999 to be
+// sent, so other codes are replaced with CloseNormal.
+func (s *socket) CloseWithReason(code int, reason string) error {
+	if code != capngopher.CloseNormal && (code < 3000 || code > 4999) {
+		code = capngopher.CloseNormal
+	}
+	s.fail(io.EOF)
+	s.o.Call("close", code, reason)
+	return nil
+}
@@ -0,0 +1,45 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"strconv"
+)
+
+// ErrHandshakeRejected is the reason a connection failed when the server
+// refused to upgrade it to a websocket.
+var ErrHandshakeRejected = errors.New("capngopher: websocket handshake rejected")
+
+// ErrConnectionFailed is the reason a connection failed in a browser,
+// which does not say whether the server could not be reached or
+// rejected the handshake.
+var ErrConnectionFailed = errors.New("capngopher: websocket connection failed")
+
+// A DialError reports why a connection to a websocket server could not
+// be established. Its Err is the context's error if the attempt was
+// cancelled or timed out.
+type DialError struct {
+	Addr string
+
+	// Status is the HTTP status the server rejected the handshake with,
+	// or zero if it is not known. Browsers do not expose it.
+	Status int
+
+	Err error
+}
+
+func (e *DialError) Error() string {
+	if e.Status != 0 {
+		return "dial " + e.Addr + ": " + e.Err.Error() + " with status " + strconv.Itoa(e.Status)
+	}
+	return "dial " + e.Addr + ": " + e.Err.Error()
+}
+
+func (e *DialError) Unwrap() error {
+	return e.Err
+}
+
+// Timeout reports whether the attempt timed out.
+func (e *DialError) Timeout() bool {
+	return errors.Is(e.Err, context.DeadlineExceeded)
+}
@@ -0,0 +1,82 @@
+package client
+
+import (
+	"net/url"
+
+	"zombiezen.com/go/capnproto2/rpc"
+
+	"github.com/kothar/capngopher"
+	"github.com/kothar/capngopher/ws"
+)
+
+// A DialOption configures how Dial connects to a websocket server.
+type DialOption func(config *dialConfig)
+
+// WithProtocols offers the server the given subprotocols, in order of
+// preference, instead of ws.Protocols. Each must be one of ws.Protocols
+// or ws.ProtocolDeflate, as the negotiated subprotocol selects the
+// encoding of the transport.
+func WithProtocols(protocols ...string) DialOption {
+	return func(config *dialConfig) {
+		config.protocols = append([]string(nil), protocols...)
+	}
+}
+
+// WithQuery adds a parameter to the query string of the websocket
+// address. Browsers cannot set headers on websocket requests, so this
+// is how they pass credentials.
+func WithQuery(key, value string) DialOption {
+	return func(config *dialConfig) {
+		if config.query == nil {
+			config.query = make(url.Values)
+		}
+		config.query.Add(key, value)
+	}
+}
+
+// WithAccessToken passes a bearer token in the access_token query
+// parameter, where server.BearerToken looks for it when a request has
+// no Authorization header.
+func WithAccessToken(token string) DialOption {
+	return WithQuery("access_token", token)
+}
+
+// WithTransportOptions configures the transport created for the
+// connection.
+func WithTransportOptions(options ...capngopher.TransportOption) DialOption {
+	return func(config *dialConfig) {
+		config.transport = append(config.transport, options...)
+	}
+}
+
+// WithRPCOptions configures the RPC connection started by DialClient.
+func WithRPCOptions(options ...rpc.ConnOption) DialOption {
+	return func(config *dialConfig) {
+		config.rpc = append(config.rpc, options...)
+	}
+}
+
+func newDialConfig(options []DialOption) *dialConfig {
+	config := &dialConfig{protocols: ws.Protocols}
+	for _, option := range options {
+		option(config)
+	}
+	return config
+}
+
+// location returns addr with the configured query parameters added.
+func (config *dialConfig) location(addr string) (string, error) {
+	if len(config.query) == 0 {
+		return addr, nil
+	}
+	u, err := url.Parse(addr)
+	if err != nil {
+		return "", err
+	}
+	query := u.Query()
+	for key, values := range config.query {
+		query[key] = append(query[key], values...)
+	}
+	u.RawQuery = query.Encode()
+	return u.String(), nil
+}
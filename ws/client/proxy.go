@@ -0,0 +1,96 @@
+//go:build !js
+// +build !js
+
+package client
+
+import (
+	"bufio"
+	"crypto/tls"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+)
+
+// proxyFor returns the URL of the proxy to connect to location through,
+// or nil to connect directly.
+func (config *dialConfig) proxyFor(location *url.URL) (*url.URL, error) {
+	proxy := config.proxy
+	if proxy == nil {
+		proxy = http.ProxyFromEnvironment
+	}
+
+	u := *location
+	u.Scheme = "http"
+	if location.Scheme == "wss" {
+		u.Scheme = "https"
+	}
+	proxyURL, err := proxy(&http.Request{Method: "GET", URL: &u, Host: u.Host, Header: make(http.Header)})
+	if err != nil || proxyURL == nil {
+		return nil, err
+	}
+	if proxyURL.Scheme != "http" && proxyURL.Scheme != "https" {
+		return nil, fmt.Errorf("capngopher: unsupported proxy scheme %q", proxyURL.Scheme)
+	}
+	return proxyURL, nil
+}
+
+// connectProxy asks the proxy conn is connected to for a tunnel to
+// target, returning the connection to use for the tunnel. Connections
+// to https proxies use the configured TLS configuration, with the
+// proxy's name.
+func (config *dialConfig) connectProxy(conn net.Conn, proxy *url.URL, target string) (net.Conn, error) {
+	if proxy.Scheme == "https" {
+		tlsConfig := config.tlsConfig.Clone()
+		if tlsConfig == nil {
+			tlsConfig = new(tls.Config)
+		}
+		tlsConfig.ServerName = proxy.Hostname()
+		tc := tls.Client(conn, tlsConfig)
+		if err := tc.Handshake(); err != nil {
+			return conn, err
+		}
+		conn = tc
+	}
+
+	req := &http.Request{
+		Method: "CONNECT",
+		URL:    &url.URL{Opaque: target},
+		Host:   target,
+		Header: make(http.Header),
+	}
+	if user := proxy.User; user != nil {
+		password, _ := user.Password()
+		credentials := base64.StdEncoding.EncodeToString([]byte(user.Username() + ":" + password))
+		req.Header.Set("Proxy-Authorization", "Basic "+credentials)
+	}
+	if err := req.Write(conn); err != nil {
+		return conn, err
+	}
+
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, req)
+	if err != nil {
+		return conn, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return conn, fmt.Errorf("capngopher: proxy %s refused tunnel: %s", proxy.Host, resp.Status)
+	}
+	if br.Buffered() > 0 {
+		return &bufferedConn{Conn: conn, r: br}, nil
+	}
+	return conn, nil
+}
+
+// bufferedConn is a connection some of whose input has already been
+// read into a buffer.
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *bufferedConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
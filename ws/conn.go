@@ -0,0 +1,110 @@
+// Package ws adapts websocket connections for use with capngopher's
+// message-framed transport.
+package ws
+
+import (
+	"encoding/binary"
+	"time"
+
+	"golang.org/x/net/websocket"
+
+	"github.com/kothar/capngopher"
+)
+
+// Conn is a websocket connection which sends each message as a single
+// binary frame, and control messages as text frames. It implements
+// capngopher.ControlConn and capngopher.ReasonCloser.
+type Conn struct {
+	*websocket.Conn
+}
+
+// NewConn wraps a websocket connection.
+func NewConn(c *websocket.Conn) *Conn {
+	c.PayloadType = websocket.BinaryFrame
+	return &Conn{Conn: c}
+}
+
+// frame is a message together with its websocket payload type.
+type frame struct {
+	data        []byte
+	payloadType byte
+}
+
+// frameCodec sends and receives frames without losing their payload
+// type, which websocket.Message does not report.
+var frameCodec = websocket.Codec{
+	Marshal: func(v interface{}) ([]byte, byte, error) {
+		f := v.(frame)
+		return f.data, f.payloadType, nil
+	},
+	Unmarshal: func(data []byte, payloadType byte, v interface{}) error {
+		*v.(*frame) = frame{data: data, payloadType: payloadType}
+		return nil
+	},
+}
+
+// ReadMessage reads the payload of the next binary frame, discarding
+// control messages. Frames larger than the connection's
+// MaxPayloadBytes are rejected with a *capngopher.LimitError.
+func (c *Conn) ReadMessage() ([]byte, error) {
+	for {
+		p, control, err := c.ReadFrame()
+		if err != nil || !control {
+			return p, err
+		}
+	}
+}
+
+// ReadFrame reads the payload of the next frame, reporting whether it
+// was a text frame carrying a control message.
+func (c *Conn) ReadFrame() ([]byte, bool, error) {
+	var f frame
+	if err := frameCodec.Receive(c.Conn, &f); err == websocket.ErrFrameTooLarge {
+		return nil, false, &capngopher.LimitError{Limit: "size", Max: c.MaxPayloadBytes}
+	} else if err != nil {
+		return nil, false, err
+	}
+	return f.data, f.payloadType == websocket.TextFrame, nil
+}
+
+// SetMaxMessageSize sets the size in bytes of the largest frame which
+// will be read.
+func (c *Conn) SetMaxMessageSize(n int) {
+	c.MaxPayloadBytes = n
+}
+
+// WriteMessage sends p as a single binary frame.
+func (c *Conn) WriteMessage(p []byte) error {
+	return frameCodec.Send(c.Conn, frame{data: p, payloadType: websocket.BinaryFrame})
+}
+
+// WriteControl sends p as a text frame.
+func (c *Conn) WriteControl(p []byte) error {
+	return frameCodec.Send(c.Conn, frame{data: p, payloadType: websocket.TextFrame})
+}
+
+// WriteClose sends a close frame carrying code and reason.
+func (c *Conn) WriteClose(code int, reason string) error {
+	p := make([]byte, 2, 2+len(reason))
+	binary.BigEndian.PutUint16(p, uint16(code))
+	p = append(p, reason...)
+	return frameCodec.Send(c.Conn, frame{data: p, payloadType: websocket.CloseFrame})
+}
+
+// CloseWithReason sends a close frame carrying code and reason, then
+// closes the connection.
+func (c *Conn) CloseWithReason(code int, reason string) error {
+	err := c.WriteClose(code, reason)
+	c.Close()
+	return err
+}
+
+// Close closes the connection without waiting for writes in progress,
+// which fail. No close frame is sent: use CloseWithReason to send one.
+func (c *Conn) Close() error {
+	// The expired deadline unblocks writes in progress, and stops the
+	// websocket library writing a close frame of its own.
+	c.Conn.SetWriteDeadline(time.Now())
+	c.Conn.Close()
+	return nil
+}
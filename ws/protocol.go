@@ -0,0 +1,57 @@
+package ws
+
+import (
+	"github.com/kothar/capngopher"
+)
+
+// Websocket subprotocols, each of which selects an encoding for the
+// Cap'n Proto messages sent on the connection.
+//
+// Each Cap'n Proto message is sent as one binary frame. Peers which
+// negotiate one of these subprotocols also exchange control messages,
+// sent as text frames of the form "<kind> <argument>":
+//
+//	ping <n>               asks the peer to reply with "pong <n>"
+//	pong <n>               answers a ping
+//	close <code> <reason>  says why the connection is being closed
+//	goaway <reason>        says the connection will soon be closed
+//
+// Peers ignore kinds they do not know. Keepalive pings are control
+// messages rather than websocket ping frames, because the websocket
+// library answers ping frames and consumes pongs without reporting
+// them.
+const (
+	ProtocolRPC     = "capnp-rpc"
+	ProtocolPacked  = "capnp-rpc-packed"
+	ProtocolDeflate = "capnp-rpc-deflate"
+)
+
+// Protocols lists the subprotocols offered and accepted by default, in
+// order of preference. ProtocolDeflate is supported but not among them,
+// since compression costs CPU time on both peers: it is only negotiated
+// if both choose it with WithProtocols.
+var Protocols = []string{ProtocolPacked, ProtocolRPC}
+
+// ControlMessages reports whether a peer which negotiated protocol
+// understands capngopher's control messages, which are part of the
+// subprotocols. Peers which negotiated no subprotocol may not, and are
+// sent none.
+func ControlMessages(protocol string) bool {
+	return protocol != ""
+}
+
+// Encoding returns the encoding selected by a negotiated subprotocol.
+// Connections which negotiated no subprotocol use plain encoding, for
+// compatibility with peers which do not offer one.
+func Encoding(protocol string) (capngopher.Encoding, bool) {
+	switch protocol {
+	case "", ProtocolRPC:
+		return capngopher.EncodingPlain, true
+	case ProtocolPacked:
+		return capngopher.EncodingPacked, true
+	case ProtocolDeflate:
+		return capngopher.EncodingDeflate, true
+	default:
+		return 0, false
+	}
+}
@@ -0,0 +1,273 @@
+package server
+
+import (
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// sweepInterval is how often the listener forgets clients which have no
+// connections and have not connected recently.
+const sweepInterval = time.Minute
+
+// A Ban refuses connections from an IP address.
+type Ban struct {
+	IP net.IP
+
+	// Until is when the ban expires, or the zero time if it does not.
+	Until time.Time
+}
+
+// admission tracks the connections and connection rate of each client
+// IP address, and the addresses which are banned.
+type admission struct {
+	mu      sync.Mutex
+	clients map[string]*client
+	bans    map[string]Ban
+	swept   time.Time
+}
+
+type client struct {
+	conns  int
+	tokens float64 // connections which may be opened now
+	last   time.Time
+}
+
+// Ban refuses connections from ip with 403 Forbidden for d, or until
+// Unban is called if d is zero. Connections which are already open are
+// not affected.
+func (l *WebsocketListener) Ban(ip net.IP, d time.Duration) {
+	ban := Ban{IP: ip}
+	if d > 0 {
+		ban.Until = time.Now().Add(d)
+	}
+
+	a := &l.admission
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.bans == nil {
+		a.bans = make(map[string]Ban)
+	}
+	a.bans[ip.String()] = ban
+}
+
+// Unban lifts any ban on ip.
+func (l *WebsocketListener) Unban(ip net.IP) {
+	a := &l.admission
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	delete(a.bans, ip.String())
+}
+
+// Bans returns the bans in force.
+func (l *WebsocketListener) Bans() []Ban {
+	a := &l.admission
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	now := time.Now()
+	bans := make([]Ban, 0, len(a.bans))
+	for key, ban := range a.bans {
+		if !ban.Until.IsZero() && now.After(ban.Until) {
+			delete(a.bans, key)
+			continue
+		}
+		bans = append(bans, ban)
+	}
+	return bans
+}
+
+// banned reports whether ip is banned. The caller must hold a.mu.
+func (a *admission) banned(ip net.IP, now time.Time) bool {
+	key := ip.String()
+	ban, ok := a.bans[key]
+	if ok && !ban.Until.IsZero() && now.After(ban.Until) {
+		delete(a.bans, key)
+		return false
+	}
+	return ok
+}
+
+// admit counts a new connection from ip. If it is refused, admit
+// returns the status to refuse it with and why, and for 429 Too Many
+// Requests how long the client should wait before trying again.
+func (l *WebsocketListener) admit(ip net.IP) (status int, reason string, retry time.Duration) {
+	a := &l.admission
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	now := time.Now()
+	if a.banned(ip, now) {
+		return http.StatusForbidden, "address is banned", 0
+	}
+	if l.maxConnsPerIP <= 0 && l.connRate <= 0 {
+		return 0, "", 0
+	}
+
+	if now.Sub(a.swept) > sweepInterval {
+		a.sweep(l, now)
+	}
+	if a.clients == nil {
+		a.clients = make(map[string]*client)
+	}
+	key := ip.String()
+	c := a.clients[key]
+	if c == nil {
+		c = &client{tokens: float64(l.connBurst), last: now}
+		a.clients[key] = c
+	}
+
+	if l.maxConnsPerIP > 0 && c.conns >= l.maxConnsPerIP {
+		return http.StatusTooManyRequests, "too many connections from address", l.retryAfter
+	}
+	if l.connRate > 0 {
+		c.refill(l, now)
+		if c.tokens < 1 {
+			wait := time.Duration((1 - c.tokens) / l.connRate * float64(time.Second))
+			return http.StatusTooManyRequests, "connection rate exceeded", wait
+		}
+		c.tokens--
+	}
+	c.conns++
+	return 0, "", 0
+}
+
+// release stops counting a connection from ip admitted by admit.
+func (l *WebsocketListener) release(ip net.IP) {
+	a := &l.admission
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if c := a.clients[ip.String()]; c != nil {
+		c.conns--
+	}
+}
+
+// refill adds the connections allowed since c last connected.
+func (c *client) refill(l *WebsocketListener, now time.Time) {
+	c.tokens += now.Sub(c.last).Seconds() * l.connRate
+	if c.tokens > float64(l.connBurst) {
+		c.tokens = float64(l.connBurst)
+	}
+	c.last = now
+}
+
+// sweep forgets clients which have no connections and whose rate limit
+// has been restored. The caller must hold a.mu.
+func (a *admission) sweep(l *WebsocketListener, now time.Time) {
+	for key, c := range a.clients {
+		if c.conns > 0 {
+			continue
+		}
+		if l.connRate > 0 {
+			c.refill(l, now)
+			if c.tokens < float64(l.connBurst) {
+				continue
+			}
+		}
+		delete(a.clients, key)
+	}
+	a.swept = now
+}
+
+// clientIP returns the IP address of the client which made r, or nil if
+// it is not known. Requests from trusted proxies are attributed to the
+// last address in X-Forwarded-For which is not itself a trusted proxy.
+func (l *WebsocketListener) clientIP(r *http.Request) net.IP {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	ip := net.ParseIP(host)
+	if ip == nil || !l.trustedProxy(ip) {
+		return ip
+	}
+
+	hops := strings.Split(strings.Join(r.Header.Values("X-Forwarded-For"), ","), ",")
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := net.ParseIP(strings.TrimSpace(hops[i]))
+		if hop == nil {
+			break
+		}
+		ip = hop
+		if !l.trustedProxy(hop) {
+			break
+		}
+	}
+	return ip
+}
+
+func (l *WebsocketListener) trustedProxy(ip net.IP) bool {
+	for _, n := range l.trustedProxies {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// refuse rejects a request from a client which may not connect.
+func (l *WebsocketListener) refuse(w http.ResponseWriter, r *http.Request, status int, reason string, retry time.Duration) {
+	log.Println("Rejected websocket connection from", r.RemoteAddr+":", reason)
+
+	if retry > 0 {
+		seconds := int((retry + time.Second - 1) / time.Second)
+		w.Header().Set("Retry-After", strconv.Itoa(seconds))
+	}
+	http.Error(w, http.StatusText(status), status)
+}
+
+// WithMaxConnectionsPerIP limits the number of open websocket
+// connections from each client IP address. Further requests are refused
+// with 429 Too Many Requests.
+func WithMaxConnectionsPerIP(n int) ListenerOption {
+	return func(l *WebsocketListener) {
+		l.maxConnsPerIP = n
+	}
+}
+
+// WithConnectionRatePerIP limits each client IP address to opening n
+// connections per period, in bursts of up to n. Further requests are
+// refused with 429 Too Many Requests and a Retry-After header. A period
+// which is not positive is logged and ignored.
+func WithConnectionRatePerIP(n int, per time.Duration) ListenerOption {
+	return func(l *WebsocketListener) {
+		if per <= 0 {
+			log.Println("Ignoring connection rate period:", per)
+			return
+		}
+		l.connRate = float64(n) / per.Seconds()
+		l.connBurst = n
+	}
+}
+
+// WithTrustedProxies trusts the X-Forwarded-For header of requests from
+// the given addresses or CIDR ranges, such as "10.0.0.0/8", to name the
+// client. Per-IP limits and bans then apply to the client, and its
+// address is reported as the connection's remote address. Invalid
+// entries are logged and ignored.
+func WithTrustedProxies(proxies ...string) ListenerOption {
+	return func(l *WebsocketListener) {
+		for _, p := range proxies {
+			if !strings.Contains(p, "/") {
+				if ip := net.ParseIP(p); ip != nil {
+					bits := 8 * len(ip.To16())
+					if ip.To4() != nil {
+						ip, bits = ip.To4(), 32
+					}
+					l.trustedProxies = append(l.trustedProxies, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+					continue
+				}
+			}
+			_, n, err := net.ParseCIDR(p)
+			if err != nil {
+				log.Println("Ignoring trusted proxy:", err)
+				continue
+			}
+			l.trustedProxies = append(l.trustedProxies, n)
+		}
+	}
+}
@@ -0,0 +1,192 @@
+package server
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// admittedStatus is the status of requests which pass admission, given
+// by the authenticator of admissionListener.
+const admittedStatus = http.StatusTeapot
+
+// admissionListener returns a listener whose authenticator refuses
+// every request it sees with admittedStatus, after recording the remote
+// address it was given and waiting for hold, if it is not nil.
+func admissionListener(seen chan<- string, hold <-chan struct{}, options ...ListenerOption) *WebsocketListener {
+	auth := AuthenticatorFunc(func(r *http.Request) (interface{}, error) {
+		if seen != nil {
+			seen <- r.RemoteAddr
+		}
+		if hold != nil {
+			<-hold
+		}
+		return nil, &AuthError{Status: admittedStatus}
+	})
+	return NewListener(append(options, WithAuthenticator(auth))...)
+}
+
+// request serves a request from remoteAddr, with the given
+// X-Forwarded-For headers.
+func request(l *WebsocketListener, remoteAddr string, forwardedFor ...string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest("GET", "/", nil)
+	r.RemoteAddr = remoteAddr
+	for _, f := range forwardedFor {
+		r.Header.Add("X-Forwarded-For", f)
+	}
+	w := httptest.NewRecorder()
+	l.ServeHTTP(w, r)
+	return w
+}
+
+// retryAfter returns the Retry-After header of w in seconds, or zero.
+func retryAfter(w *httptest.ResponseRecorder) int {
+	n, _ := strconv.Atoi(w.Header().Get("Retry-After"))
+	return n
+}
+
+func TestClientIP(t *testing.T) {
+	tests := []struct {
+		name         string
+		proxies      []string
+		remoteAddr   string
+		forwardedFor []string
+		want         string
+	}{
+		{"direct", nil, "1.2.3.4:1000", nil, "1.2.3.4:1000"},
+		{"spoofed by untrusted peer", nil, "6.6.6.6:1000", []string{"1.2.3.4"}, "6.6.6.6:1000"},
+		{"spoofed by peer outside range", []string{"10.0.0.0/8"}, "11.0.0.1:1000", []string{"1.2.3.4"}, "11.0.0.1:1000"},
+		{"trusted proxy", []string{"10.0.0.1"}, "10.0.0.1:1000", []string{"1.2.3.4"}, "1.2.3.4"},
+		{"trusted range", []string{"10.0.0.0/8"}, "10.1.2.3:1000", []string{"1.2.3.4"}, "1.2.3.4"},
+		{"chain of proxies", []string{"10.0.0.0/8"}, "10.0.0.1:1000", []string{"1.2.3.4, 10.0.0.2, 10.0.0.3"}, "1.2.3.4"},
+		{"chain across headers", []string{"10.0.0.0/8"}, "10.0.0.1:1000", []string{"6.6.6.6", "1.2.3.4, 10.0.0.2"}, "1.2.3.4"},
+		{"spoofed behind proxy", []string{"10.0.0.0/8"}, "10.0.0.1:1000", []string{"6.6.6.6, 1.2.3.4"}, "1.2.3.4"},
+		{"only proxies", []string{"10.0.0.0/8"}, "10.0.0.1:1000", []string{"10.0.0.2"}, "10.0.0.2"},
+		{"no header", []string{"10.0.0.0/8"}, "10.0.0.1:1000", nil, "10.0.0.1:1000"},
+		{"garbage last", []string{"10.0.0.0/8"}, "10.0.0.1:1000", []string{"1.2.3.4, garbage"}, "10.0.0.1:1000"},
+		{"garbage before client", []string{"10.0.0.0/8"}, "10.0.0.1:1000", []string{"garbage, 1.2.3.4"}, "1.2.3.4"},
+		{"garbage behind proxy", []string{"10.0.0.0/8"}, "10.0.0.1:1000", []string{"1.2.3.4, , 10.0.0.2"}, "10.0.0.2"},
+		{"ipv6", []string{"fd00::/8"}, "[fd00::1]:1000", []string{"2001:db8::1"}, "2001:db8::1"},
+		{"invalid proxy ignored", []string{"10.0.0.0/40"}, "10.0.0.1:1000", []string{"1.2.3.4"}, "10.0.0.1:1000"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			seen := make(chan string, 1)
+			l := admissionListener(seen, nil, WithTrustedProxies(test.proxies...))
+			if w := request(l, test.remoteAddr, test.forwardedFor...); w.Code != admittedStatus {
+				t.Fatalf("status %d; want %d", w.Code, admittedStatus)
+			}
+			if got := <-seen; got != test.want {
+				t.Errorf("remote address %q; want %q", got, test.want)
+			}
+		})
+	}
+}
+
+func TestBan(t *testing.T) {
+	l := admissionListener(nil, nil, WithTrustedProxies("10.0.0.0/8"))
+	ip := net.ParseIP("1.2.3.4")
+
+	l.Ban(ip, 0)
+	if w := request(l, "1.2.3.4:1000"); w.Code != http.StatusForbidden {
+		t.Errorf("banned address: status %d; want %d", w.Code, http.StatusForbidden)
+	}
+	if w := request(l, "10.0.0.1:1000", "1.2.3.4"); w.Code != http.StatusForbidden {
+		t.Errorf("banned address behind proxy: status %d; want %d", w.Code, http.StatusForbidden)
+	}
+	if w := request(l, "1.2.3.5:1000"); w.Code != admittedStatus {
+		t.Errorf("other address: status %d; want %d", w.Code, admittedStatus)
+	}
+	l.Unban(ip)
+	if w := request(l, "1.2.3.4:1000"); w.Code != admittedStatus {
+		t.Errorf("unbanned address: status %d; want %d", w.Code, admittedStatus)
+	}
+
+	l.Ban(ip, 20*time.Millisecond)
+	if w := request(l, "1.2.3.4:1000"); w.Code != http.StatusForbidden {
+		t.Errorf("temporarily banned address: status %d; want %d", w.Code, http.StatusForbidden)
+	}
+	if bans := l.Bans(); len(bans) != 1 || !bans[0].IP.Equal(ip) {
+		t.Errorf("Bans() = %v; want a ban on %v", bans, ip)
+	}
+	time.Sleep(40 * time.Millisecond)
+	if w := request(l, "1.2.3.4:1000"); w.Code != admittedStatus {
+		t.Errorf("expired ban: status %d; want %d", w.Code, admittedStatus)
+	}
+	if bans := l.Bans(); len(bans) != 0 {
+		t.Errorf("Bans() = %v after expiry; want none", bans)
+	}
+}
+
+func TestConnectionRatePerIP(t *testing.T) {
+	l := admissionListener(nil, nil, WithConnectionRatePerIP(2, time.Hour))
+	for i := 0; i < 2; i++ {
+		if w := request(l, "1.2.3.4:1000"); w.Code != admittedStatus {
+			t.Fatalf("request %d: status %d; want %d", i, w.Code, admittedStatus)
+		}
+	}
+	w := request(l, "1.2.3.4:1000")
+	if w.Code != http.StatusTooManyRequests {
+		t.Fatalf("status %d; want %d", w.Code, http.StatusTooManyRequests)
+	}
+	// Half an hour until another connection is allowed
+	if n := retryAfter(w); n < 1790 || n > 1800 {
+		t.Errorf("Retry-After %d; want about 1800", n)
+	}
+	if w := request(l, "1.2.3.5:1000"); w.Code != admittedStatus {
+		t.Errorf("other address: status %d; want %d", w.Code, admittedStatus)
+	}
+}
+
+func TestMaxConnectionsPerIP(t *testing.T) {
+	seen := make(chan string, 1)
+	hold := make(chan struct{})
+	l := admissionListener(seen, hold, WithMaxConnectionsPerIP(1), WithRetryAfter(7*time.Second))
+	done := make(chan int)
+	go func() {
+		done <- request(l, "1.2.3.4:1000").Code
+	}()
+	<-seen
+
+	// Refused requests are not counted, so they must not be released
+	// either.
+	for i := 0; i < 3; i++ {
+		w := request(l, "1.2.3.4:1001")
+		if w.Code != http.StatusTooManyRequests {
+			t.Fatalf("status %d; want %d", w.Code, http.StatusTooManyRequests)
+		}
+		if n := retryAfter(w); n != 7 {
+			t.Errorf("Retry-After %d; want 7", n)
+		}
+	}
+	close(hold)
+	if code := <-done; code != admittedStatus {
+		t.Errorf("held request: status %d; want %d", code, admittedStatus)
+	}
+	if n := l.admission.clients["1.2.3.4"].conns; n != 0 {
+		t.Errorf("%d connections counted after all were closed; want 0", n)
+	}
+}
+
+func TestSweep(t *testing.T) {
+	l := admissionListener(nil, nil, WithMaxConnectionsPerIP(10), WithConnectionRatePerIP(10, time.Hour))
+	request(l, "1.2.3.4:1000")
+	l.admission.clients["1.2.3.5"] = &client{tokens: 10, last: time.Now()}
+
+	// Clients with no connections are forgotten once their rate limit
+	// has been restored.
+	l.admission.swept = time.Now().Add(-2 * sweepInterval)
+	request(l, "1.2.3.6:1000")
+	if _, ok := l.admission.clients["1.2.3.5"]; ok {
+		t.Error("idle client with full rate not swept")
+	}
+	if _, ok := l.admission.clients["1.2.3.4"]; !ok {
+		t.Error("client with a depleted rate swept")
+	}
+	if _, ok := l.admission.clients["1.2.3.6"]; !ok {
+		t.Error("new client not counted")
+	}
+}
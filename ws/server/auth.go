@@ -0,0 +1,85 @@
+package server
+
+import (
+	"crypto/x509"
+	"errors"
+	"net/http"
+	"strings"
+)
+
+// An Authenticator checks the credentials of a websocket upgrade
+// request before it is accepted. The principal it returns is passed on
+// to the connection in capngopher.ConnInfo.
+//
+// Returning an error rejects the request: with the status of an
+// *AuthError, or 401 Unauthorized for any other error.
+type Authenticator interface {
+	Authenticate(r *http.Request) (principal interface{}, err error)
+}
+
+// AuthenticatorFunc adapts a function to the Authenticator interface.
+type AuthenticatorFunc func(r *http.Request) (interface{}, error)
+
+func (f AuthenticatorFunc) Authenticate(r *http.Request) (interface{}, error) {
+	return f(r)
+}
+
+// An AuthError rejects an upgrade request with a specific HTTP status.
+type AuthError struct {
+	Status int
+	Reason string
+}
+
+func (e *AuthError) Error() string {
+	return e.Reason
+}
+
+var errNoCredentials = &AuthError{Status: http.StatusUnauthorized, Reason: "no credentials"}
+
+// authStatus returns the HTTP status to reject a request with.
+func authStatus(err error) int {
+	var authErr *AuthError
+	if errors.As(err, &authErr) && authErr.Status != 0 {
+		return authErr.Status
+	}
+	return http.StatusUnauthorized
+}
+
+// BearerToken authenticates requests carrying a token, either in an
+// "Authorization: Bearer" header or, since browsers cannot set headers
+// on websocket requests, in the access_token query parameter.
+func BearerToken(validate func(token string) (interface{}, error)) Authenticator {
+	return AuthenticatorFunc(func(r *http.Request) (interface{}, error) {
+		token := r.URL.Query().Get("access_token")
+		if auth := r.Header.Get("Authorization"); strings.HasPrefix(auth, "Bearer ") {
+			token = strings.TrimPrefix(auth, "Bearer ")
+		}
+		if token == "" {
+			return nil, errNoCredentials
+		}
+		return validate(token)
+	})
+}
+
+// SessionCookie authenticates requests carrying the named cookie.
+func SessionCookie(name string, validate func(value string) (interface{}, error)) Authenticator {
+	return AuthenticatorFunc(func(r *http.Request) (interface{}, error) {
+		cookie, err := r.Cookie(name)
+		if err != nil {
+			return nil, errNoCredentials
+		}
+		return validate(cookie.Value)
+	})
+}
+
+// ClientCertificate authenticates requests made over TLS with a client
+// certificate which has been verified by the HTTP server. The server's
+// tls.Config must set ClientAuth to verify certificates.
+func ClientCertificate(validate func(cert *x509.Certificate) (interface{}, error)) Authenticator {
+	return AuthenticatorFunc(func(r *http.Request) (interface{}, error) {
+		if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 {
+			return nil, errNoCredentials
+		}
+		return validate(r.TLS.VerifiedChains[0][0])
+	})
+}
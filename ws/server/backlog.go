@@ -0,0 +1,124 @@
+package server
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// DefaultBacklog is the number of upgraded connections which may wait
+// to be accepted unless configured otherwise.
+const DefaultBacklog = 128
+
+// defaultRetryAfter is how long clients refused by an overloaded
+// listener are asked to wait before trying again.
+const defaultRetryAfter = 5 * time.Second
+
+// backlogSlot is a place in the listener's accept queue, held from
+// before the upgrade until the connection is accepted.
+type backlogSlot struct {
+	l    *WebsocketListener
+	once sync.Once
+}
+
+// acquireSlot reserves a place in the accept queue, waiting up to the
+// accept timeout for one to come free.
+func (l *WebsocketListener) acquireSlot(ctx context.Context) (*backlogSlot, bool) {
+	select {
+	case l.slots <- struct{}{}:
+		return &backlogSlot{l: l}, true
+	default:
+	}
+	if l.acceptTimeout <= 0 {
+		return nil, false
+	}
+
+	timer := time.NewTimer(l.acceptTimeout)
+	defer timer.Stop()
+	select {
+	case l.slots <- struct{}{}:
+		return &backlogSlot{l: l}, true
+	case <-timer.C:
+	case <-ctx.Done():
+	case <-l.done:
+	}
+	return nil, false
+}
+
+// release gives up the slot. Releasing more than once, or releasing a
+// nil slot, has no effect.
+func (s *backlogSlot) release() {
+	if s == nil {
+		return
+	}
+	s.once.Do(func() {
+		<-s.l.slots
+	})
+}
+
+// addConn counts a new connection, reporting false if the listener
+// already has its maximum number of connections.
+func (l *WebsocketListener) addConn() bool {
+	if l.maxConns <= 0 {
+		atomic.AddInt64(&l.conns, 1)
+		return true
+	}
+	for {
+		n := atomic.LoadInt64(&l.conns)
+		if n >= int64(l.maxConns) {
+			return false
+		}
+		if atomic.CompareAndSwapInt64(&l.conns, n, n+1) {
+			return true
+		}
+	}
+}
+
+func (l *WebsocketListener) removeConn() {
+	atomic.AddInt64(&l.conns, -1)
+}
+
+// overloaded refuses a request with 503 Service Unavailable, asking the
+// client to try again later.
+func (l *WebsocketListener) overloaded(w http.ResponseWriter, r *http.Request, reason string) {
+	l.refuse(w, r, http.StatusServiceUnavailable, reason, l.retryAfter)
+}
+
+// WithBacklog sets the number of upgraded connections which may wait
+// for Accept. Requests which arrive while the backlog is full are
+// refused with 503 Service Unavailable. The default is DefaultBacklog,
+// and the backlog is at least one.
+func WithBacklog(n int) ListenerOption {
+	return func(l *WebsocketListener) {
+		l.backlog = n
+	}
+}
+
+// WithAcceptTimeout makes requests which arrive while the backlog is
+// full wait up to d for a place before they are refused. Upgraded
+// connections which are not accepted within d are closed with the close
+// code capngopher.CloseTryAgainLater.
+func WithAcceptTimeout(d time.Duration) ListenerOption {
+	return func(l *WebsocketListener) {
+		l.acceptTimeout = d
+	}
+}
+
+// WithMaxConnections limits the number of open websocket connections,
+// including those waiting to be accepted. Further requests are refused
+// with 503 Service Unavailable.
+func WithMaxConnections(n int) ListenerOption {
+	return func(l *WebsocketListener) {
+		l.maxConns = n
+	}
+}
+
+// WithRetryAfter sets the Retry-After header sent with requests refused
+// because the listener is overloaded. The default is 5 seconds.
+func WithRetryAfter(d time.Duration) ListenerOption {
+	return func(l *WebsocketListener) {
+		l.retryAfter = d
+	}
+}
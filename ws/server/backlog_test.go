@@ -0,0 +1,126 @@
+package server
+
+import (
+	"context"
+	"encoding/binary"
+	"io"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/kothar/capngopher"
+)
+
+// accept accepts a connection from l, which must arrive within a
+// second.
+func accept(t *testing.T, l *WebsocketListener) {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	tr, err := l.AcceptContext(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		tr.Close()
+	})
+}
+
+// wantRefused checks that resp refused a request as overloaded.
+func wantRefused(t *testing.T, resp *http.Response, retryAfter string) {
+	t.Helper()
+	if resp.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("status %d; want %d", resp.StatusCode, http.StatusServiceUnavailable)
+	}
+	if got := resp.Header.Get("Retry-After"); got != retryAfter {
+		t.Errorf("Retry-After %q; want %q", got, retryAfter)
+	}
+}
+
+func TestBacklogFull(t *testing.T) {
+	l, srv := serve(t, WithBacklog(1))
+	if resp := upgrade(t, srv, nil); resp.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("status %d; want %d", resp.StatusCode, http.StatusSwitchingProtocols)
+	}
+	wantRefused(t, upgrade(t, srv, nil), "5")
+
+	// Accepting the queued connection makes room for another
+	accept(t, l)
+	if resp := upgrade(t, srv, nil); resp.StatusCode != http.StatusSwitchingProtocols {
+		t.Errorf("status %d; want %d", resp.StatusCode, http.StatusSwitchingProtocols)
+	}
+}
+
+func TestAcceptTimeoutWaitsForSlot(t *testing.T) {
+	l, srv := serve(t, WithBacklog(1), WithAcceptTimeout(time.Second))
+	upgrade(t, srv, nil)
+
+	status := make(chan int, 1)
+	go func() {
+		status <- upgrade(t, srv, nil).StatusCode
+	}()
+	time.Sleep(50 * time.Millisecond)
+	accept(t, l)
+	if got := <-status; got != http.StatusSwitchingProtocols {
+		t.Errorf("status %d; want %d", got, http.StatusSwitchingProtocols)
+	}
+}
+
+func TestAcceptTimeoutDropsQueued(t *testing.T) {
+	l, srv := serve(t, WithAcceptTimeout(50*time.Millisecond))
+	resp := upgrade(t, srv, nil)
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("status %d; want %d", resp.StatusCode, http.StatusSwitchingProtocols)
+	}
+
+	// An unmasked close frame carrying the close code
+	body := resp.Body.(io.ReadWriteCloser)
+	frame := make([]byte, 4)
+	if _, err := io.ReadFull(body, frame); err != nil {
+		t.Fatal(err)
+	}
+	if frame[0] != 0x88 {
+		t.Fatalf("received frame %#x; want a close frame", frame[0])
+	}
+	if code := binary.BigEndian.Uint16(frame[2:]); code != capngopher.CloseTryAgainLater {
+		t.Errorf("close code %d; want %d", code, capngopher.CloseTryAgainLater)
+	}
+
+	// The dropped connection is not accepted
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, err := l.AcceptContext(ctx); err != context.DeadlineExceeded {
+		t.Errorf("AcceptContext = %v; want %v", err, context.DeadlineExceeded)
+	}
+}
+
+func TestMaxConnections(t *testing.T) {
+	l, srv := serve(t, WithMaxConnections(1), WithRetryAfter(time.Minute))
+	if resp := upgrade(t, srv, nil); resp.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("status %d; want %d", resp.StatusCode, http.StatusSwitchingProtocols)
+	}
+
+	// Connections waiting to be accepted count, as do accepted ones
+	wantRefused(t, upgrade(t, srv, nil), "60")
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	tr, err := l.AcceptContext(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wantRefused(t, upgrade(t, srv, nil), "60")
+
+	// Closing the connection makes room for another
+	tr.Close()
+	deadline := time.Now().Add(time.Second)
+	for {
+		resp := upgrade(t, srv, nil)
+		if resp.StatusCode == http.StatusSwitchingProtocols {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("status %d after closing; want %d", resp.StatusCode, http.StatusSwitchingProtocols)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -1,69 +1,548 @@
 package server
 
 import (
+	"context"
+	"errors"
+	"fmt"
 	"log"
 	"net"
+	"net/http"
+	"path"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"zombiezen.com/go/capnproto2/rpc"
 
 	"golang.org/x/net/websocket"
+
+	"github.com/kothar/capngopher"
+	"github.com/kothar/capngopher/ws"
 )
 
 type wsConn struct {
-	*websocket.Conn
+	*ws.Conn
+
+	info       capngopher.ConnInfo
+	localAddr  net.Addr
+	remoteAddr net.Addr
+	slot       *backlogSlot
+	claimed    int32 // set by whichever of Accept or handle takes the connection
+	close      chan struct{}
+	closeOnce  sync.Once
+}
 
-	close chan struct{}
+// claim takes the connection for Accept, or for handle to drop,
+// reporting false if it has already been taken.
+func (w *wsConn) claim() bool {
+	return atomic.CompareAndSwapInt32(&w.claimed, 0, 1)
 }
 
 // Close overrides the default behaviour to pass a message back to
-// the websocket handler
+// the websocket handler, which closes the connection when it returns.
+// Closing more than once has no further effect.
 func (w *wsConn) Close() error {
-	w.close <- struct{}{}
+	w.closeOnce.Do(func() {
+		close(w.close)
+	})
 	return nil
 }
 
+// CloseWithReason sends a close frame carrying code and reason before
+// closing the connection.
+func (w *wsConn) CloseWithReason(code int, reason string) error {
+	var err error
+	w.closeOnce.Do(func() {
+		err = w.WriteClose(code, reason)
+		close(w.close)
+	})
+	return err
+}
+
+// A WebsocketListener accepts websocket connections. It is an
+// http.Handler: mount it on an HTTP server, and the requests it
+// upgrades are returned by Accept.
 type WebsocketListener struct {
-	connections chan net.Conn
+	conns int64 // open connections, accessed atomically
+
+	connections chan *wsConn
+	slots       chan struct{}
+
+	maxMessageSize   int
+	maxSegments      int
+	traverseLimit    uint64
+	authenticator    Authenticator
+	allowedOrigins   []string
+	handshake        func(config *websocket.Config, r *http.Request) error
+	handshakeTimeout time.Duration
+	protocols        []string
+	keepalive        time.Duration
+	idleTimeout      time.Duration
+	sendQueue        int
+	queuePolicy      capngopher.QueuePolicy
+	backlog          int
+	acceptTimeout    time.Duration
+	maxConns         int
+	retryAfter       time.Duration
+	maxConnsPerIP    int
+	connRate         float64 // connections per second from each IP
+	connBurst        int
+	trustedProxies   []*net.IPNet
+	admission        admission
+
+	addr     net.Addr
+	seenAddr atomic.Value // net.Addr of the first request
+
+	done      chan struct{}
+	closeOnce sync.Once
 }
 
+// Accept waits for the next websocket connection. It returns
+// capngopher.ErrListenerClosed once the listener has been closed.
 func (l *WebsocketListener) Accept() (rpc.Transport, error) {
-	c := <-l.connections
-	return rpc.StreamTransport(c), nil
+	return l.AcceptContext(context.Background())
+}
+
+// AcceptContext is like Accept, but gives up and returns the context's
+// error if ctx is done before a connection arrives.
+func (l *WebsocketListener) AcceptContext(ctx context.Context) (rpc.Transport, error) {
+	c, err := l.acceptConn(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return l.transport(c), nil
+}
+
+// acceptConn takes the next connection from the queue.
+func (l *WebsocketListener) acceptConn(ctx context.Context) (*wsConn, error) {
+	for {
+		select {
+		case c := <-l.connections:
+			if !c.claim() {
+				// Dropped by handle when the listener closed
+				continue
+			}
+			c.slot.release()
+			return c, nil
+		case <-l.done:
+			return nil, capngopher.ErrListenerClosed
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// transport creates a transport for an accepted connection.
+func (l *WebsocketListener) transport(c *wsConn) rpc.Transport {
+	var options []capngopher.TransportOption
+	if l.maxMessageSize > 0 {
+		options = append(options, capngopher.WithMaxMessageSize(l.maxMessageSize))
+	}
+	if l.maxSegments > 0 {
+		options = append(options, capngopher.WithMaxSegments(l.maxSegments))
+	}
+	if l.traverseLimit > 0 {
+		options = append(options, capngopher.WithTraversalLimit(l.traverseLimit))
+	}
+	if l.keepalive > 0 && ws.ControlMessages(c.info.Protocol) {
+		options = append(options, capngopher.WithKeepalive(l.keepalive, l.idleTimeout))
+	}
+	if l.sendQueue > 0 {
+		options = append(options, capngopher.WithSendQueue(l.sendQueue, l.queuePolicy))
+	}
+	if encoding, ok := ws.Encoding(c.info.Protocol); ok {
+		options = append(options, capngopher.WithEncoding(encoding))
+	}
+	if !ws.ControlMessages(c.info.Protocol) {
+		options = append(options, capngopher.WithoutControlMessages())
+	}
+	t := capngopher.NewMessageTransport(c, options...)
+	return capngopher.WithConnInfo(t, c.info)
 }
 
 // Close closes the listener.
-// Any blocked Accept operations will be unblocked and return errors.
+// Any blocked Accept operations will be unblocked and return
+// capngopher.ErrListenerClosed, and new websocket connections will be
+// refused. Connections which have already been accepted are not
+// affected.
 func (l *WebsocketListener) Close() error {
-	close(l.connections)
+	l.closeOnce.Do(func() {
+		close(l.done)
+	})
 	return nil
 }
 
-// Addr returns the listener's network address.
+// Addr returns the listener's network address: the address set with
+// WithAddr, or else the local address of the HTTP server, as seen by
+// the first request the listener served. Before then it returns an
+// address with an empty string.
 func (l *WebsocketListener) Addr() net.Addr {
-	return nil
+	if l.addr != nil {
+		return l.addr
+	}
+	if addr, ok := l.seenAddr.Load().(net.Addr); ok {
+		return addr
+	}
+	return wsAddr("")
+}
+
+// ServeHTTP upgrades the request to a websocket connection to be
+// returned by Accept. Once the listener has been closed, requests are
+// refused with 503 Service Unavailable instead.
+//
+// If the listener has an Authenticator, it is run before the upgrade
+// and requests which fail authentication are refused.
+//
+// Requests are also refused with 503 Service Unavailable and a
+// Retry-After header if the listener has its maximum number of
+// connections, or if its backlog of connections waiting for Accept is
+// full. Clients which are banned are refused with 403 Forbidden, and
+// clients which exceed their per-IP limits with 429 Too Many Requests.
+func (l *WebsocketListener) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if l.seenAddr.Load() == nil {
+		if addr := localAddr(r); addr != nil {
+			l.seenAddr.Store(addr)
+		}
+	}
+
+	select {
+	case <-l.done:
+		http.Error(w, "Server is shutting down", http.StatusServiceUnavailable)
+		return
+	default:
+	}
+
+	ip := l.clientIP(r)
+	if ip != nil {
+		if host, _, _ := net.SplitHostPort(r.RemoteAddr); host != ip.String() {
+			// Report the client behind the proxy rather than the proxy
+			r.RemoteAddr = ip.String()
+		}
+		if status, reason, retry := l.admit(ip); status != 0 {
+			l.refuse(w, r, status, reason, retry)
+			return
+		}
+		defer l.release(ip)
+	}
+
+	if len(l.allowedOrigins) > 0 && !l.originAllowed(r.Header.Get("Origin")) {
+		log.Println("Rejected websocket connection from", r.RemoteAddr+": origin", r.Header.Get("Origin"), "not allowed")
+		http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+		return
+	}
+
+	if !l.addConn() {
+		l.overloaded(w, r, "too many connections")
+		return
+	}
+	defer l.removeConn()
+
+	if l.authenticator != nil {
+		principal, err := l.authenticator.Authenticate(r)
+		if err != nil {
+			log.Println("Rejected websocket connection from", r.RemoteAddr+":", err)
+			status := authStatus(err)
+			http.Error(w, http.StatusText(status), status)
+			return
+		}
+		r = r.WithContext(context.WithValue(r.Context(), principalKey, principal))
+	}
+
+	slot, ok := l.acquireSlot(r.Context())
+	if !ok {
+		l.overloaded(w, r, "accept backlog full")
+		return
+	}
+	defer slot.release()
+	r = r.WithContext(context.WithValue(r.Context(), slotKey, slot))
+
+	if l.handshakeTimeout > 0 {
+		// The deadlines stay on the connection once it is hijacked, so
+		// they cover the websocket handshake. handle clears them.
+		deadline := time.Now().Add(l.handshakeTimeout)
+		rc := http.NewResponseController(w)
+		rc.SetReadDeadline(deadline)
+		rc.SetWriteDeadline(deadline)
+	}
+
+	websocket.Server{Handshake: l.checkHandshake, Handler: l.handle}.ServeHTTP(w, r)
+}
+
+// originAllowed reports whether origin matches one of the allowed
+// origins.
+func (l *WebsocketListener) originAllowed(origin string) bool {
+	if origin == "" {
+		return false
+	}
+	for _, pattern := range l.allowedOrigins {
+		if ok, _ := path.Match(pattern, origin); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// checkHandshake is called by the websocket server once it has read the
+// upgrade request.
+func (l *WebsocketListener) checkHandshake(config *websocket.Config, r *http.Request) error {
+	var err error
+	config.Origin, err = websocket.Origin(config, r)
+	if err == nil && config.Origin == nil {
+		err = errors.New("null origin")
+	}
+	if err == nil {
+		err = l.negotiateProtocol(config)
+	}
+	if err == nil && l.handshake != nil {
+		err = l.handshake(config, r)
+	}
+	if err == nil && len(config.Protocol) == 1 {
+		if _, ok := ws.Encoding(config.Protocol[0]); !ok {
+			err = fmt.Errorf("unsupported subprotocol %q", config.Protocol[0])
+		}
+	}
+
+	if err != nil {
+		log.Println("Rejected websocket handshake from", r.RemoteAddr+":", err)
+	}
+	return err
 }
 
-func (l *WebsocketListener) Handler(ws *websocket.Conn) {
+// negotiateProtocol selects the listener's most preferred subprotocol
+// among those offered by the client. Clients which offer none are
+// served with plain encoding, but clients which offer only unsupported
+// subprotocols are refused.
+func (l *WebsocketListener) negotiateProtocol(config *websocket.Config) error {
+	offered := config.Protocol
+	if len(offered) == 0 {
+		return nil
+	}
+
+	protocols := l.protocols
+	if protocols == nil {
+		protocols = ws.Protocols
+	}
+	for _, protocol := range protocols {
+		for _, o := range offered {
+			if o == protocol {
+				config.Protocol = []string{protocol}
+				return nil
+			}
+		}
+	}
+	return fmt.Errorf("no supported subprotocol in %q", offered)
+}
+
+// handle queues a connection upgraded by ServeHTTP for Accept, and
+// holds it open until it is closed.
+func (l *WebsocketListener) handle(conn *websocket.Conn) {
 	log.Println("Accepted new websocket connection")
 
-	// Set payload type
-	ws.PayloadType = websocket.BinaryFrame
+	// Clear any deadlines left over from the handshake or the HTTP server
+	conn.SetDeadline(time.Time{})
+	if l.maxMessageSize > 0 {
+		conn.MaxPayloadBytes = l.maxMessageSize
+	}
 
 	c := &wsConn{
-		Conn:  ws,
-		close: make(chan struct{}),
+		Conn:       ws.NewConn(conn),
+		info:       connInfo(conn),
+		localAddr:  localAddr(conn.Request()),
+		remoteAddr: remoteAddr(conn.Request()),
+		close:      make(chan struct{}),
+	}
+	if c.localAddr == nil {
+		c.localAddr = l.Addr()
+	}
+	// The slot reserved by ServeHTTP guarantees room in the queue
+	c.slot, _ = conn.Request().Context().Value(slotKey).(*backlogSlot)
+
+	select {
+	case l.connections <- c:
+	case <-l.done:
+		log.Println("Listener closed, dropping websocket connection")
+		return
+	}
+
+	var expired <-chan time.Time
+	if l.acceptTimeout > 0 {
+		timer := time.NewTimer(l.acceptTimeout)
+		defer timer.Stop()
+		expired = timer.C
 	}
-	l.connections <- c
 
 	// Wait for the close signal
-	<-c.close
+	for {
+		select {
+		case <-c.close:
+			return
+		case <-expired:
+			expired = nil
+			if c.claim() {
+				log.Println("Websocket connection not accepted in time, dropping it")
+				c.WriteClose(capngopher.CloseTryAgainLater, "not accepted in time")
+				return
+			}
+		case <-l.done:
+			if c.claim() {
+				log.Println("Listener closed, dropping websocket connection")
+				return
+			}
+			<-c.close
+			return
+		}
+	}
+}
+
+// connInfo describes the request which opened conn.
+func connInfo(conn *websocket.Conn) capngopher.ConnInfo {
+	r := conn.Request()
+	info := capngopher.ConnInfo{
+		RemoteAddr: r.RemoteAddr,
+		URL:        r.URL,
+		Header:     r.Header,
+		Cookies:    r.Cookies(),
+		TLS:        r.TLS,
+		Principal:  r.Context().Value(principalKey),
+	}
+	if protocols := conn.Config().Protocol; len(protocols) == 1 {
+		info.Protocol = protocols[0]
+	}
+	return info
+}
+
+type contextKey int
+
+const (
+	principalKey contextKey = iota
+	slotKey
+)
+
+type ListenerOption func(l *WebsocketListener)
+
+// WithAuthenticator checks every upgrade request with the authenticator
+// a before the connection is upgraded.
+func WithAuthenticator(a Authenticator) ListenerOption {
+	return func(l *WebsocketListener) {
+		l.authenticator = a
+	}
+}
+
+// WithMaxMessageSize sets the size in bytes of the largest message
+// which will be accepted from a peer. Each websocket frame carries one
+// message. Peers which exceed this limit or WithMaxSegments are
+// disconnected with the close code capngopher.CloseMessageTooBig.
+func WithMaxMessageSize(n int) ListenerOption {
+	return func(l *WebsocketListener) {
+		l.maxMessageSize = n
+	}
+}
+
+// WithMaxSegments sets the largest number of segments a message from a
+// peer may have.
+func WithMaxSegments(n int) ListenerOption {
+	return func(l *WebsocketListener) {
+		l.maxSegments = n
+	}
+}
+
+// WithTraversalLimit sets the number of bytes which may be read from
+// each message received from a peer. See
+// capngopher.WithTraversalLimit.
+func WithTraversalLimit(bytes uint64) ListenerOption {
+	return func(l *WebsocketListener) {
+		l.traverseLimit = bytes
+	}
+}
+
+// WithAllowedOrigins only accepts upgrade requests whose Origin header
+// matches one of origins, refusing others with 403 Forbidden. An origin
+// may contain wildcards, such as "https://*.example.com".
+//
+// Without this option any origin is accepted, which leaves connections
+// authenticated by cookies open to cross-site websocket hijacking.
+func WithAllowedOrigins(origins ...string) ListenerOption {
+	return func(l *WebsocketListener) {
+		l.allowedOrigins = append(l.allowedOrigins, origins...)
+	}
+}
+
+// WithHandshake calls f during the websocket handshake, after the
+// origin has been checked and a subprotocol negotiated. Returning an
+// error refuses the connection with 403 Forbidden. f may also override
+// the subprotocol in config.Protocol with another supported one.
+func WithHandshake(f func(config *websocket.Config, r *http.Request) error) ListenerOption {
+	return func(l *WebsocketListener) {
+		l.handshake = f
+	}
+}
+
+// WithHandshakeTimeout closes connections which do not complete the
+// websocket handshake within d.
+func WithHandshakeTimeout(d time.Duration) ListenerOption {
+	return func(l *WebsocketListener) {
+		l.handshakeTimeout = d
+	}
 }
 
-func NewListener() *WebsocketListener {
+// WithKeepalive pings each connection every interval and closes it if
+// nothing has been received from the peer for timeout. The round-trip
+// time of the pings is reported by capngopher.Conn.RTT.
+//
+// The pings are control messages, which only peers that negotiated a
+// subprotocol understand; see ws.Protocols. Connections which
+// negotiated none are not pinged, and have no idle timeout.
+func WithKeepalive(interval, timeout time.Duration) ListenerOption {
+	return func(l *WebsocketListener) {
+		l.keepalive = interval
+		l.idleTimeout = timeout
+	}
+}
+
+// WithSendQueue gives each connection a send queue holding up to
+// maxBytes, so that a client which stops reading cannot hold up the
+// goroutines sending to it. policy decides what happens when the queue
+// is full; see capngopher.WithSendQueue. The queue's depth is reported
+// by capngopher.Conn.QueueStats.
+func WithSendQueue(maxBytes int, policy capngopher.QueuePolicy) ListenerOption {
+	return func(l *WebsocketListener) {
+		l.sendQueue = maxBytes
+		l.queuePolicy = policy
+	}
+}
+
+// WithProtocols sets the subprotocols the listener will negotiate, in
+// order of preference. By default those in ws.Protocols are; include
+// ws.ProtocolDeflate to compress messages for clients which offer it.
+func WithProtocols(protocols ...string) ListenerOption {
+	return func(l *WebsocketListener) {
+		l.protocols = append(l.protocols, protocols...)
+	}
+}
+
+// WithAddr sets the address reported by Addr, such as the public
+// address of the server the listener is mounted on.
+func WithAddr(addr net.Addr) ListenerOption {
+	return func(l *WebsocketListener) {
+		l.addr = addr
+	}
+}
+
+func NewListener(options ...ListenerOption) *WebsocketListener {
 
 	listener := &WebsocketListener{
-		connections: make(chan net.Conn),
+		backlog:    DefaultBacklog,
+		retryAfter: defaultRetryAfter,
+		done:       make(chan struct{}),
+	}
+	for _, option := range options {
+		option(listener)
+	}
+	if listener.backlog < 1 {
+		listener.backlog = 1
 	}
+	listener.connections = make(chan *wsConn, listener.backlog)
+	listener.slots = make(chan struct{}, listener.backlog)
 
 	return listener
 }
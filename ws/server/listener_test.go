@@ -0,0 +1,204 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/net/websocket"
+
+	"github.com/kothar/capngopher"
+	"github.com/kothar/capngopher/ws"
+)
+
+// serve mounts a listener made with options on a test HTTP server.
+func serve(t *testing.T, options ...ListenerOption) (*WebsocketListener, *httptest.Server) {
+	l := NewListener(options...)
+	srv := httptest.NewServer(l)
+	t.Cleanup(func() {
+		l.Close()
+		srv.Close()
+	})
+	return l, srv
+}
+
+// upgrade sends a websocket upgrade request to srv, letting edit
+// change it first, and returns the response.
+func upgrade(t *testing.T, srv *httptest.Server, edit func(r *http.Request)) *http.Response {
+	t.Helper()
+	r, err := http.NewRequest("GET", srv.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Header.Set("Connection", "Upgrade")
+	r.Header.Set("Upgrade", "websocket")
+	r.Header.Set("Sec-WebSocket-Version", "13")
+	r.Header.Set("Sec-WebSocket-Key", "dGhlIHNhbXBsZSBub25jZQ==")
+	r.Header.Set("Origin", "https://app.example.com")
+	if edit != nil {
+		edit(r)
+	}
+	resp, err := http.DefaultClient.Do(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		resp.Body.Close()
+	})
+	return resp
+}
+
+// wsURL returns the websocket address of srv.
+func wsURL(srv *httptest.Server) string {
+	return "ws" + strings.TrimPrefix(srv.URL, "http")
+}
+
+func TestServeHTTPRefused(t *testing.T) {
+	token := func(token string) (interface{}, error) {
+		if token != "secret" {
+			return nil, errors.New("bad token")
+		}
+		return "alice", nil
+	}
+	fails := func(err error) ListenerOption {
+		return WithAuthenticator(AuthenticatorFunc(func(r *http.Request) (interface{}, error) {
+			return nil, err
+		}))
+	}
+	tests := []struct {
+		name    string
+		options []ListenerOption
+		edit    func(r *http.Request)
+		status  int
+	}{
+		{"accepted", nil, nil, http.StatusSwitchingProtocols},
+		{"no token", []ListenerOption{WithAuthenticator(BearerToken(token))}, nil, http.StatusUnauthorized},
+		{"bad token", []ListenerOption{WithAuthenticator(BearerToken(token))}, func(r *http.Request) {
+			r.Header.Set("Authorization", "Bearer wrong")
+		}, http.StatusUnauthorized},
+		{"token header", []ListenerOption{WithAuthenticator(BearerToken(token))}, func(r *http.Request) {
+			r.Header.Set("Authorization", "Bearer secret")
+		}, http.StatusSwitchingProtocols},
+		{"token query", []ListenerOption{WithAuthenticator(BearerToken(token))}, func(r *http.Request) {
+			r.URL.RawQuery = "access_token=secret"
+		}, http.StatusSwitchingProtocols},
+		{"no cookie", []ListenerOption{WithAuthenticator(SessionCookie("session", token))}, nil, http.StatusUnauthorized},
+		{"auth error", []ListenerOption{fails(&AuthError{Status: http.StatusForbidden, Reason: "suspended"})}, nil, http.StatusForbidden},
+		{"auth error without status", []ListenerOption{fails(&AuthError{Reason: "expired"})}, nil, http.StatusUnauthorized},
+		{"wrapped auth error", []ListenerOption{fails(fmt.Errorf("session: %w", &AuthError{Status: http.StatusPaymentRequired}))}, nil, http.StatusPaymentRequired},
+		{"origin not allowed", []ListenerOption{WithAllowedOrigins("https://example.com")}, nil, http.StatusForbidden},
+		{"no origin", []ListenerOption{WithAllowedOrigins("https://*.example.com")}, func(r *http.Request) {
+			r.Header.Del("Origin")
+		}, http.StatusForbidden},
+		{"origin allowed", []ListenerOption{WithAllowedOrigins("https://*.example.com")}, nil, http.StatusSwitchingProtocols},
+		{"unsupported subprotocol", nil, func(r *http.Request) {
+			r.Header.Set("Sec-WebSocket-Protocol", "chat")
+		}, http.StatusForbidden},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, srv := serve(t, test.options...)
+			if resp := upgrade(t, srv, test.edit); resp.StatusCode != test.status {
+				t.Errorf("status %d; want %d", resp.StatusCode, test.status)
+			}
+		})
+	}
+}
+
+func TestServeHTTPClosed(t *testing.T) {
+	l, srv := serve(t)
+	l.Close()
+	if resp := upgrade(t, srv, nil); resp.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("status %d; want %d", resp.StatusCode, http.StatusServiceUnavailable)
+	}
+}
+
+func TestOriginAllowed(t *testing.T) {
+	l := NewListener(WithAllowedOrigins("https://example.com", "https://*.example.com", "http://localhost:*"))
+	tests := []struct {
+		origin string
+		ok     bool
+	}{
+		{"https://example.com", true},
+		{"https://app.example.com", true},
+		{"http://localhost:8080", true},
+		{"", false},
+		{"null", false},
+		{"http://example.com", false},
+		{"https://example.com.evil.com", false},
+		{"https://a.b.example.com", true},
+		{"https://evilexample.com", false},
+	}
+	for _, test := range tests {
+		if ok := l.originAllowed(test.origin); ok != test.ok {
+			t.Errorf("originAllowed(%q) = %t; want %t", test.origin, ok, test.ok)
+		}
+	}
+}
+
+func TestPrincipal(t *testing.T) {
+	l, srv := serve(t, WithAuthenticator(BearerToken(func(token string) (interface{}, error) {
+		return "user:" + token, nil
+	})))
+	config, err := websocket.NewConfig(wsURL(srv)+"/?access_token=alice", srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config.Protocol = []string{"capnp-rpc"}
+	conn, err := websocket.DialConfig(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	tr, err := l.AcceptContext(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tr.Close()
+	info := capngopher.TransportInfo(tr)
+	if info.Principal != "user:alice" {
+		t.Errorf("Principal = %v; want %q", info.Principal, "user:alice")
+	}
+	if info.Protocol != "capnp-rpc" {
+		t.Errorf("Protocol = %q; want %q", info.Protocol, "capnp-rpc")
+	}
+}
+
+func TestNegotiateProtocol(t *testing.T) {
+	all := []string{ws.ProtocolDeflate, ws.ProtocolPacked, ws.ProtocolRPC}
+	tests := []struct {
+		name    string
+		options []ListenerOption
+		offered []string
+		want    string
+	}{
+		{"default", nil, all, ws.ProtocolPacked},
+		{"deflate not accepted by default", nil, []string{ws.ProtocolDeflate}, ""},
+		{"deflate opted in", []ListenerOption{WithProtocols(ws.ProtocolDeflate, ws.ProtocolRPC)}, all, ws.ProtocolDeflate},
+		{"client preference ignored", nil, []string{ws.ProtocolRPC, ws.ProtocolPacked}, ws.ProtocolPacked},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			l := NewListener(test.options...)
+			config := &websocket.Config{Protocol: test.offered}
+			err := l.negotiateProtocol(config)
+			if test.want == "" {
+				if err == nil {
+					t.Errorf("negotiated %q; want an error", config.Protocol)
+				}
+				return
+			}
+			if err != nil || len(config.Protocol) != 1 || config.Protocol[0] != test.want {
+				t.Errorf("negotiated %q, %v; want %q", config.Protocol, err, test.want)
+			}
+		})
+	}
+}
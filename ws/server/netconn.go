@@ -0,0 +1,97 @@
+package server
+
+import (
+	"context"
+	"net"
+	"net/http"
+
+	"golang.org/x/net/websocket"
+
+	"github.com/kothar/capngopher"
+)
+
+// wsAddr is the address of a websocket endpoint which has no better
+// network address.
+type wsAddr string
+
+func (a wsAddr) Network() string { return "websocket" }
+func (a wsAddr) String() string  { return string(a) }
+
+// remoteAddr parses the remote address of a request. Requests from
+// trusted proxies have the client's address, which has no port.
+func remoteAddr(r *http.Request) net.Addr {
+	if addr, err := net.ResolveTCPAddr("tcp", r.RemoteAddr); err == nil {
+		return addr
+	}
+	if ip := net.ParseIP(r.RemoteAddr); ip != nil {
+		return &net.TCPAddr{IP: ip}
+	}
+	return wsAddr(r.RemoteAddr)
+}
+
+// localAddr returns the address a request arrived on, as recorded by
+// the HTTP server, or nil if it is not known.
+func localAddr(r *http.Request) net.Addr {
+	addr, _ := r.Context().Value(http.LocalAddrContextKey).(net.Addr)
+	return addr
+}
+
+// netListener accepts websocket connections as net.Conns.
+type netListener struct {
+	l *WebsocketListener
+}
+
+// NetListener returns a net.Listener which accepts websocket
+// connections from l as byte streams. Each Write is sent as a binary
+// frame, and Read returns the contents of frames in order.
+//
+// The net.Listener and l share one queue of connections, so a
+// connection is returned by only one of them.
+func (l *WebsocketListener) NetListener() net.Listener {
+	return netListener{l: l}
+}
+
+func (n netListener) Accept() (net.Conn, error) {
+	c, err := n.l.acceptConn(context.Background())
+	if err != nil {
+		return nil, err
+	}
+	return &netConn{Conn: c.Conn.Conn, c: c}, nil
+}
+
+func (n netListener) Close() error {
+	return n.l.Close()
+}
+
+func (n netListener) Addr() net.Addr {
+	return n.l.Addr()
+}
+
+// netConn is an accepted websocket connection used as a net.Conn.
+type netConn struct {
+	*websocket.Conn
+
+	c *wsConn
+}
+
+// Close closes the connection. Closing more than once has no further
+// effect.
+func (n *netConn) Close() error {
+	return n.c.Close()
+}
+
+// LocalAddr returns the address the connection arrived on.
+func (n *netConn) LocalAddr() net.Addr {
+	return n.c.localAddr
+}
+
+// RemoteAddr returns the address of the peer, rather than the origin
+// returned by websocket.Conn.
+func (n *netConn) RemoteAddr() net.Addr {
+	return n.c.remoteAddr
+}
+
+// ConnInfo describes the request which opened the connection.
+func (n *netConn) ConnInfo() capngopher.ConnInfo {
+	return n.c.info
+}